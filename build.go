@@ -59,7 +59,7 @@ var config = Config{
 	Name:             "ariadne-daemon",                          // name of the program executable and directory
 	Namespace:        "github.com/ariadne-tools/ariadne-daemon", // subdir of GOPATH, e.g. "github.com/foo/bar"
 	Main:             "./cmd/",                                  // package name for the main package
-	DefaultBuildTags: []string{"selfupdate"},                    // specify build tags which are always used
+	DefaultBuildTags: []string{"selfupdate", "sqlite_fts5"},     // specify build tags which are always used
 	Tests:            []string{"./..."},                         // tests to run
 	MinVersion:       GoVersion{Major: 1, Minor: 11, Patch: 0},  // minimum Go version supported
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/jsonrpc"
+	"github.com/ariadne-tools/ariadne-daemon/internal/listener"
+)
+
+// The exit statuses of the client commands.
+const (
+	exitOK           = 0
+	exitFailure      = 1 // the daemon couldn't do what it was asked to
+	exitUsage        = 2 // bad flags or arguments
+	exitUnavailable  = 3 // the daemon can't be reached
+	exitUnauthorized = 4 // the token is missing, invalid, or it doesn't grant the command
+	exitNotFound     = 5 // some of the watched dirs or directories given don't exist
+	exitInterrupted  = 130
+)
+
+const clientExitStatus = `
+EXIT STATUS
+===========
+
+0 if the command was successful, 1 if the daemon failed to do it, 2 on bad
+usage or if the daemon refused the arguments, 3 if the daemon can't be reached,
+4 if the token was refused, and 5 if some of the given watched dirs or
+directories don't exist.
+`
+
+type clientOptions struct {
+	address   string
+	token     string
+	tokenFile string
+	json      bool
+}
+
+var clientOpts clientOptions
+
+// addClientFlags adds the flags telling how to reach the daemon to cmd.
+func addClientFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+	flags.StringVarP(&clientOpts.address, "address", "a", "localhost:9000", "the address of the daemon: unix:/path/to/socket (relative to the default --runtime-dir of the daemon) or [tcp:]host:port")
+	flags.StringVar(&clientOpts.token, "token", "", "the token to authenticate with (default is $ARIADNE_TOKEN, or the first one of --token-file)")
+	flags.StringVar(&clientOpts.tokenFile, "token-file", filepath.Join(defaultWorkDir(), tokensFile), "the token file of the daemon")
+	flags.BoolVar(&clientOpts.json, "json", false, "print the output as JSON")
+}
+
+// dial connects to the daemon, or exits if it can't.
+func dial() *rpc.Client {
+	token, err := clientToken()
+	if err != nil {
+		fail(exitUnauthorized, err)
+	}
+
+	addr := socketAddress(clientOpts.address, defaultRuntimeDir(defaultWorkDir()))
+	network, address := "tcp", strings.TrimPrefix(addr, "tcp:")
+	if strings.HasPrefix(addr, "unix:") {
+		// the options of the socket are the daemon's business
+		path, _, err := listener.ParseUnix(strings.TrimPrefix(addr, "unix:"))
+		if err != nil {
+			fail(exitUsage, err)
+		}
+		network, address = "unix", path
+	}
+	client, err := jsonrpc.DialHTTP(network, address, token)
+	if err != nil {
+		if strings.Contains(err.Error(), "401") {
+			fail(exitUnauthorized, fmt.Errorf("the daemon refused the token"))
+		}
+		fail(exitUnavailable, fmt.Errorf("cannot connect to the daemon at %s: %v", clientOpts.address, err))
+	}
+	return client
+}
+
+func clientToken() (string, error) {
+	if clientOpts.token != "" {
+		return clientOpts.token, nil
+	}
+	if token := os.Getenv("ARIADNE_TOKEN"); token != "" {
+		return token, nil
+	}
+
+	b, err := ioutil.ReadFile(clientOpts.tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("no token given, and %v", err)
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && !strings.HasPrefix(fields[0], "#") {
+			return fields[0], nil
+		}
+	}
+	return "", fmt.Errorf("no token in %s", clientOpts.tokenFile)
+}
+
+// call calls the method of RemoteCall, or exits if it fails.
+func call(client *rpc.Client, method string, args interface{}, reply interface{}) {
+	if err := client.Call("RemoteCall."+method, args, reply); err != nil {
+		switch {
+		case strings.HasPrefix(err.Error(), "auth:"):
+			fail(exitUnauthorized, err)
+		case err == rpc.ErrShutdown:
+			fail(exitUnavailable, err)
+		case jsonrpc.ErrorKind(err) == jsonrpc.InvalidArgument:
+			fail(exitUsage, err)
+		case jsonrpc.ErrorKind(err) == jsonrpc.NotFound:
+			fail(exitNotFound, err)
+		default:
+			fail(exitFailure, err)
+		}
+	}
+}
+
+func fail(status int, err error) {
+	fmt.Fprintln(os.Stderr, "ariadne-daemon:", err)
+	os.Exit(status)
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
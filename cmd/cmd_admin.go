@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/jsonrpc"
+	"github.com/ariadne-tools/ariadne-daemon/internal/progress"
+)
+
+var addCmd = &cobra.Command{
+	Use:   "add DIR...",
+	Short: "Add directories to the watched ones of the daemon",
+	Long: `
+The "add" command asks the running daemon to index the given directories and
+to keep their indices up to date.
+` + clientExitStatus,
+	Args:              cobra.MinimumNArgs(1),
+	DisableAutoGenTag: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		var dirs []string
+		for _, arg := range args {
+			dir, err := filepath.Abs(arg)
+			if err != nil {
+				fail(exitFailure, err)
+			}
+			info, err := os.Stat(dir)
+			switch {
+			case os.IsNotExist(err):
+				fail(exitNotFound, err)
+			case err != nil:
+				fail(exitFailure, err)
+			case !info.IsDir():
+				fail(exitUsage, fmt.Errorf("%s is not a directory", dir))
+			}
+			dirs = append(dirs, dir)
+		}
+
+		added := []string{}
+		call(dial(), "Add", dirs, &added)
+
+		if clientOpts.json {
+			printJSON(map[string][]string{"added": added})
+			return
+		}
+		for _, dir := range dirs {
+			if containsString(added, dir) {
+				fmt.Println("added", dir)
+			} else {
+				fmt.Println("already watched", dir)
+			}
+		}
+	},
+}
+
+var removeCmd = &cobra.Command{
+	Use:   "remove ID|DIR...",
+	Short: "Remove directories from the watched ones of the daemon",
+	Long: `
+The "remove" command asks the running daemon to stop watching the given
+directories, and to drop their indices. They can be given by their ids or
+their paths, as the "list" command prints them.
+` + clientExitStatus,
+	Args:              cobra.MinimumNArgs(1),
+	DisableAutoGenTag: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		client := dial()
+		ids, missing := watchedIds(client, args)
+
+		removed := []int{}
+		if len(ids) > 0 {
+			call(client, "Remove", ids, &removed)
+		}
+
+		if clientOpts.json {
+			printJSON(map[string]interface{}{"removed": removed, "not_found": missing})
+		} else {
+			for _, id := range removed {
+				fmt.Println("removed", id)
+			}
+		}
+		exitIfMissing(missing)
+	},
+}
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the watched directories of the daemon",
+	Long: `
+The "list" command prints the id, the state and the path of the directories
+the running daemon watches.
+` + clientExitStatus,
+	Args:              cobra.NoArgs,
+	DisableAutoGenTag: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		var dirs []jsonrpc.WatchedDirsState
+		call(dial(), "WatchedDirs", struct{}{}, &dirs)
+
+		if clientOpts.json {
+			if dirs == nil {
+				dirs = []jsonrpc.WatchedDirsState{}
+			}
+			printJSON(dirs)
+			return
+		}
+		for _, dir := range dirs {
+			fmt.Printf("%d\t%s\t%s\n", dir.Id, dir.State, dir.Path)
+		}
+	},
+}
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Tell whether the daemon is running, and what it's doing",
+	Long: `
+The "status" command checks that the daemon is running, and prints how many
+of its watched directories are being indexed, kept up to date, or removed,
+and how far the indexing of each of them got.
+` + clientExitStatus,
+	Args:              cobra.NoArgs,
+	DisableAutoGenTag: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		var dirs []progress.Dir
+		call(dial(), "Status", struct{}{}, &dirs)
+
+		states := map[string]int{"indexing": 0, "updating": 0, "wiping": 0}
+		for _, dir := range dirs {
+			states[dir.State]++
+		}
+
+		if clientOpts.json {
+			if dirs == nil {
+				dirs = []progress.Dir{}
+			}
+			printJSON(map[string]interface{}{"address": clientOpts.address, "running": true, "dirs": states, "progress": dirs})
+			return
+		}
+		fmt.Println("the daemon is running at", clientOpts.address)
+		fmt.Printf("watched dirs: %d (indexing: %d, up to date: %d, being removed: %d)\n",
+			len(dirs), states["indexing"], states["updating"], states["wiping"])
+		for _, dir := range dirs {
+			fmt.Printf("%d\t%s\t%s\n", dir.DirId, dir.State, dir.Path)
+			fmt.Println("\t" + progressSummary(dir))
+		}
+	},
+}
+
+var reindexCmd = &cobra.Command{
+	Use:   "reindex [ID|DIR...]",
+	Short: "Index watched directories again",
+	Long: `
+The "reindex" command asks the running daemon to walk the given watched
+directories again, or all of them if none is given.
+` + clientExitStatus,
+	DisableAutoGenTag: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		client := dial()
+		ids, missing := watchedIds(client, args)
+
+		reindexed := []int{}
+		if len(args) == 0 || len(ids) > 0 {
+			call(client, "Reindex", ids, &reindexed)
+		}
+
+		if clientOpts.json {
+			printJSON(map[string]interface{}{"reindexed": reindexed, "not_found": missing})
+		} else {
+			for _, id := range reindexed {
+				fmt.Println("reindexing", id)
+			}
+		}
+		exitIfMissing(missing)
+	},
+}
+
+var stopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "Stop the daemon",
+	Long: `
+The "stop" command asks the running daemon to commit its changes and exit.
+` + clientExitStatus,
+	Args:              cobra.NoArgs,
+	DisableAutoGenTag: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		call(dial(), "StopDaemon", struct{}{}, &struct{}{})
+		if clientOpts.json {
+			printJSON(map[string]bool{"stopping": true})
+			return
+		}
+		fmt.Println("the daemon is stopping")
+	},
+}
+
+// progressSummary tells how far the indexing of a dir got, in a line.
+func progressSummary(dir progress.Dir) string {
+	if dir.StartTime.IsZero() {
+		return "not started yet"
+	}
+	summary := fmt.Sprintf("%d files, %s, %d errors, %d events pending", dir.FilesScanned, byteCount(dir.BytesSeen), dir.Errors, dir.PendingEvents)
+	switch {
+	case !dir.EndTime.IsZero():
+		summary += fmt.Sprintf(", indexed in %s", dir.EndTime.Sub(dir.StartTime).Round(time.Second))
+	case dir.EstimatedRemainingMs >= 0:
+		summary += fmt.Sprintf(", about %d files and %s left, at %s", dir.EstimatedRemainingFiles,
+			(time.Duration(dir.EstimatedRemainingMs) * time.Millisecond).Round(time.Second), dir.CurrentPath)
+	default:
+		summary += ", at " + dir.CurrentPath
+	}
+	return summary
+}
+
+func byteCount(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+// watchedIds resolves the ids and the paths of watched dirs to ids. It also
+// returns the ones not watched.
+func watchedIds(client *rpc.Client, args []string) ([]int, []string) {
+	missing := []string{}
+	if len(args) == 0 {
+		return nil, missing
+	}
+	var dirs []jsonrpc.WatchedDirsState
+	call(client, "WatchedDirs", struct{}{}, &dirs)
+
+	var ids []int
+	for _, arg := range args {
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			id = -1
+			if abs, err := filepath.Abs(arg); err == nil {
+				arg = abs
+			}
+		}
+		found := false
+		for _, dir := range dirs {
+			if dir.Id == id || dir.Path == arg {
+				ids = append(ids, dir.Id)
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, arg)
+		}
+	}
+	return ids, missing
+}
+
+func exitIfMissing(missing []string) {
+	if len(missing) == 0 {
+		return
+	}
+	if !clientOpts.json {
+		for _, m := range missing {
+			fmt.Fprintln(os.Stderr, "ariadne-daemon: not watched:", m)
+		}
+	}
+	os.Exit(exitNotFound)
+}
+
+func containsString(strs []string, s string) bool {
+	for _, v := range strs {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{addCmd, removeCmd, listCmd, statusCmd, reindexCmd, stopCmd} {
+		addClientFlags(cmd)
+		rootCmd.AddCommand(cmd)
+	}
+}
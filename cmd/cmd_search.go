@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/jsonrpc"
+	"github.com/ariadne-tools/ariadne-daemon/internal/search"
+)
+
+type searchOptions struct {
+	ignoreCase bool
+	regex      bool
+	count      bool
+	limit      int
+	null       bool
+	existing   bool
+	basename   bool
+}
+
+var searchOpts searchOptions
+
+var searchCmd = &cobra.Command{
+	Use:     "search PATTERN...",
+	Aliases: []string{"locate"},
+	Short:   "Print the indexed files matching the patterns, like locate",
+	Long: `
+The "search" command prints the files and directories the running daemon has
+indexed whose path matches any of the patterns, one per line.
+
+A pattern without wildcards matches the paths containing it. A pattern with
+the wildcards *, ? or [...] has to match the whole path. With --regex the
+patterns are Go regular expressions. With --basename they are matched against
+the last element of the paths only.
+
+EXIT STATUS
+===========
+
+0 if anything was found, 1 if nothing was, 130 if it was interrupted, and the
+statuses of the other client commands (see "ariadne-daemon help list") on
+errors.
+`,
+	Args:              cobra.MinimumNArgs(1),
+	DisableAutoGenTag: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		if searchOpts.limit < 0 {
+			fail(exitUsage, fmt.Errorf("negative limit %d", searchOpts.limit))
+		}
+		client := dial()
+		id := searchId()
+		// the search would go on in the daemon until it times out
+		interrupted := make(chan os.Signal, 1)
+		signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-interrupted
+			var canceled bool
+			client.Call("RemoteCall.Cancel", id, &canceled)
+			os.Exit(exitInterrupted)
+		}()
+
+		out := bufio.NewWriter(os.Stdout)
+		separator := "\n"
+		if searchOpts.null {
+			separator = "\x00"
+		}
+
+		found := 0
+		seen := make(map[string]struct{})
+	Patterns:
+		for _, pattern := range args {
+			req := searchRequest(pattern, id)
+			for {
+				if searchOpts.limit > 0 {
+					req.Limit = searchOpts.limit - found
+				}
+
+				var reply jsonrpc.SearchReply
+				call(client, "Find", req, &reply)
+				if reply.TimedOut {
+					fmt.Fprintf(os.Stderr, "ariadne-daemon: the search of %q timed out, its results are incomplete\n", pattern)
+				}
+				for _, f := range reply.Files {
+					p := f.Path_to_file + f.Fname
+					if _, in := seen[p]; in {
+						continue
+					}
+					seen[p] = struct{}{}
+					if searchOpts.existing {
+						if _, err := os.Lstat(p); err != nil {
+							continue
+						}
+					}
+
+					found++
+					if !searchOpts.count {
+						out.WriteString(p + separator)
+					}
+					if found == searchOpts.limit {
+						break Patterns
+					}
+				}
+
+				if reply.NextCursor == "" {
+					break
+				}
+				req.Cursor = reply.NextCursor
+			}
+		}
+
+		if searchOpts.count {
+			fmt.Fprintln(out, found)
+		}
+		out.Flush()
+		if found == 0 {
+			os.Exit(exitFailure)
+		}
+	},
+}
+
+// searchId returns a random id for the searches, to cancel them on an interrupt.
+func searchId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// searchRequest makes the request of a pattern of the search command, with
+// the id it's canceled by.
+func searchRequest(pattern, id string) search.Request {
+	req := search.Request{Pattern: pattern, Scope: search.FullPath, CaseSensitive: !searchOpts.ignoreCase, Limit: search.MaxLimit, Id: id}
+	if searchOpts.basename {
+		req.Scope = search.Name
+	}
+	switch {
+	case searchOpts.regex:
+		req.Mode = search.Regex
+	case strings.ContainsAny(pattern, "*?["):
+		req.Mode = search.Glob
+	default:
+		req.Mode = search.Substring
+	}
+	return req
+}
+
+func init() {
+	flags := searchCmd.Flags()
+	flags.BoolVarP(&searchOpts.ignoreCase, "ignore-case", "i", false, "ignore the case (and the diacritics) of the names")
+	flags.BoolVarP(&searchOpts.regex, "regex", "r", false, "the patterns are regular expressions")
+	flags.BoolVarP(&searchOpts.count, "count", "c", false, "print only the number of the matches")
+	flags.IntVarP(&searchOpts.limit, "limit", "l", 0, "stop after this many matches (0 means no limit)")
+	flags.BoolVarP(&searchOpts.null, "null", "0", false, "separate the paths with NUL instead of newline, for xargs -0")
+	flags.BoolVarP(&searchOpts.existing, "existing", "e", false, "print only the files that still exist")
+	flags.BoolVarP(&searchOpts.basename, "basename", "b", false, "match the patterns against the names only, not the whole paths")
+	addClientFlags(searchCmd)
+	rootCmd.AddCommand(searchCmd)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	appDir  = "ariadne"
+	pidFile = "ariadne-daemon.pid"
+)
+
+// defaultWorkDir is where the daemon keeps its state unless --workdir is
+// given: $XDG_DATA_HOME/ariadne, or ~/.local/share/ariadne.
+func defaultWorkDir() string {
+	if dir := os.Getenv("XDG_DATA_HOME"); filepath.IsAbs(dir) {
+		return filepath.Join(dir, appDir)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "."
+	}
+	return filepath.Join(home, ".local", "share", appDir)
+}
+
+// defaultRuntimeDir is where the sockets and the pidfile are kept unless
+// --runtime-dir is given: $XDG_RUNTIME_DIR/ariadne for the default workdir,
+// $XDG_RUNTIME_DIR/ariadne-<digest of the workdir> for the others, so the
+// daemons of different workdirs don't share them, or the workdir.
+func defaultRuntimeDir(workDir string) string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if !filepath.IsAbs(dir) {
+		return workDir
+	}
+	abs, err := filepath.Abs(workDir)
+	if err != nil {
+		return workDir
+	}
+	if abs == defaultWorkDir() {
+		return filepath.Join(dir, appDir)
+	}
+	digest := sha256.Sum256([]byte(abs))
+	return filepath.Join(dir, appDir+"-"+hex.EncodeToString(digest[:8]))
+}
+
+// socketAddress puts the relative path of a unix: address into the runtime dir.
+func socketAddress(addr, runtimeDir string) string {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr && path != "" && !filepath.IsAbs(path) {
+		return "unix:" + filepath.Join(runtimeDir, path)
+	}
+	return addr
+}
@@ -1,28 +1,40 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"net/rpc"
 	"os"
-	"path"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/spf13/cobra"
 
+	"github.com/ariadne-tools/ariadne-daemon/internal/access"
+	"github.com/ariadne-tools/ariadne-daemon/internal/auth"
 	"github.com/ariadne-tools/ariadne-daemon/internal/dbconnect"
+	"github.com/ariadne-tools/ariadne-daemon/internal/fsevents"
 	"github.com/ariadne-tools/ariadne-daemon/internal/handlergenerator"
 	"github.com/ariadne-tools/ariadne-daemon/internal/jsonrpc"
+	"github.com/ariadne-tools/ariadne-daemon/internal/listener"
 	"github.com/ariadne-tools/ariadne-daemon/internal/logger"
+	"github.com/ariadne-tools/ariadne-daemon/internal/pidfile"
+	"github.com/ariadne-tools/ariadne-daemon/internal/progress"
+	"github.com/ariadne-tools/ariadne-daemon/internal/savedsearch"
+	"github.com/ariadne-tools/ariadne-daemon/internal/search"
+	"github.com/ariadne-tools/ariadne-daemon/internal/terminator"
 )
 
 const (
 	filesdb       = "files.db"
 	watcheddirsdb = "watched_dirs.db"
+	tokensFile    = "tokens"
 	commitFreq    = 2 * time.Second
 )
 
@@ -42,10 +54,17 @@ complete list of your files and directories of your chosen dir(s).`,
 }
 
 type runOptions struct {
-	workDir  string
-	port     int
-	logfile  string
-	loglevel string
+	workDir      string
+	dataDir      string
+	runtimeDir   string
+	port         int
+	listen       []string
+	tlsCert      string
+	tlsKey       string
+	clientCA     string
+	logfile      string
+	loglevel     string
+	queryTimeout time.Duration
 }
 
 var runOpts runOptions
@@ -56,55 +75,150 @@ func runRoot(options runOptions, args []string) {
 
 	logger.InfoLog("Welcome to Ariadne daemon!")
 
-	// set dir to the path of the executable
-	var dir string
-	if ex, err := os.Executable(); err != nil {
+	// the state is kept in the workdir, the dbs in the data dir and the
+	// sockets and the pidfile in the runtime dir, see the flags
+	workDir, dataDir, runtimeDir := runOpts.workDir, runOpts.dataDir, runOpts.runtimeDir
+	if dataDir == "" {
+		dataDir = workDir
+	}
+	if runtimeDir == "" {
+		runtimeDir = defaultRuntimeDir(workDir)
+	}
+	for _, dir := range []string{workDir, dataDir, runtimeDir} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			log.Fatal(err)
+		}
+	}
+	logger.InfoLog("main -> workdir:", workDir, "data dir:", dataDir, "runtime dir:", runtimeDir)
+	warnOldDbs(dataDir)
+
+	pid, err := pidfile.Lock(filepath.Join(runtimeDir, pidFile))
+	if err != nil {
 		log.Fatal(err)
-	} else {
-		dir = path.Dir(ex)
 	}
+	defer pid.Remove()
+
+	// stop like StopDaemon does, so the deferred cleanups run
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		logger.InfoLog("main -> stopping on", <-signals)
+		terminator.Terminator()
+	}()
 
 	wg := new(sync.WaitGroup)
 
-	filesDbConn := dbconnect.NewDbConnector(path.Join(dir, filesdb), commitFreq, wg)
-	watchedDbConn := dbconnect.NewDbConnector(path.Join(dir, watcheddirsdb), 0, wg)
+	filesDbConn := dbconnect.NewDbConnector(filepath.Join(dataDir, filesdb), commitFreq, wg)
+	watchedDbConn := dbconnect.NewDbConnector(filepath.Join(dataDir, watcheddirsdb), 0, wg)
 	defer filesDbConn.DB.Close()
 	defer watchedDbConn.DB.Close()
 
+	if err := filesDbConn.Migrate(dbconnect.FilesMigrations); err != nil {
+		log.Fatal(err)
+	}
+	if err := watchedDbConn.Migrate(dbconnect.WatchedMigrations); err != nil {
+		log.Fatal(err)
+	}
+	index := search.Index{Trigram: filesDbConn.EnableTrigram()}
+
 	// set all the dirs for full index
-	watchedDbConn.Exec("UPDATE watched_dirs SET state_id=?", 1)
+	if err := watchedDbConn.Exec("UPDATE watched_dirs SET state_id=?", 1); err != nil {
+		log.Fatal(err)
+	}
+
+	events := fsevents.NewBus()
+	saved, err := savedsearch.NewNotifier(watchedDbConn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go saved.Run(events)
+
+	tokens, err := auth.LoadOrCreate(filepath.Join(workDir, tokensFile))
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// setting up rpc
-	remoteFiles := jsonrpc.RemoteCall{Watcheddb: watchedDbConn, Filesdb: filesDbConn}
+	tracker := progress.NewTracker()
+	remoteFiles := jsonrpc.RemoteCall{Version: version, Watcheddb: watchedDbConn, Filesdb: filesDbConn, Index: index, Saved: saved, Tokens: tokens, Progress: tracker, Queries: jsonrpc.NewQueries(runOpts.queryTimeout)}
 	rpc.Register(remoteFiles)
-	rpc.HandleHTTP()
-	http.HandleFunc("/", func(res http.ResponseWriter, req *http.Request) {
-		io.WriteString(res, "Ariadne's RPC server live!")
-	})
-	go http.ListenAndServe(":"+strconv.Itoa(runOpts.port), nil)
+	http.Handle(rpc.DefaultRPCPath, jsonrpc.NewGobHandler(rpc.DefaultServer, remoteFiles))
+	http.Handle("/jsonrpc", jsonrpc.NewHTTPHandler(rpc.DefaultServer, remoteFiles))
+	http.Handle("/events", jsonrpc.NewEventsHandler(events, remoteFiles))
+	http.Handle("/healthz", jsonrpc.NewHealthHandler(remoteFiles))
+	http.Handle("/readyz", jsonrpc.NewReadyHandler(remoteFiles))
+	http.Handle("/metrics", jsonrpc.NewMetricsHandler(remoteFiles))
+
+	listen := runOpts.listen
+	if len(listen) == 0 {
+		listen = []string{":" + strconv.Itoa(runOpts.port)}
+	}
+	var tlsConfig *tls.Config
+	if runOpts.tlsCert != "" || runOpts.tlsKey != "" {
+		if tlsConfig, err = listener.TLSConfig(runOpts.tlsCert, runOpts.tlsKey, runOpts.clientCA); err != nil {
+			log.Fatal(err)
+		}
+	} else if runOpts.clientCA != "" {
+		log.Fatal("--client-ca needs --tls-cert and --tls-key")
+	}
+	for _, addr := range listen {
+		ln, err := listener.Listen(socketAddress(addr, runtimeDir), tlsConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer ln.Close()
+		logger.InfoLog("main -> rpc server listening on", ln.Addr().Network()+":"+ln.Addr().String())
+		server := &http.Server{ConnContext: access.ConnContext}
+		go server.Serve(ln)
+	}
 
-	go handlergenerator.ProcHandlerGenerator(watchedDbConn, filesDbConn, wg)
+	go handlergenerator.ProcHandlerGenerator(watchedDbConn, filesDbConn, events, tracker, wg)
 
 	wg.Wait()
 	logger.DebugLog("main -> Daemon exiting, bye!")
 }
 
+// warnOldDbs tells about the dbs the daemon used to keep next to its
+// executable, they have to be moved to the data dir to be used again.
+func warnOldDbs(dataDir string) {
+	ex, err := os.Executable()
+	if err != nil || filepath.Dir(ex) == dataDir {
+		return
+	}
+	for _, name := range []string{filesdb, watcheddirsdb} {
+		old := filepath.Join(filepath.Dir(ex), name)
+		if _, err := os.Stat(filepath.Join(dataDir, name)); !os.IsNotExist(err) {
+			continue
+		}
+		if _, err := os.Stat(old); err == nil {
+			logger.InfoLog("WARNING: main -> found", old, "next to the executable, move it to", dataDir, "to use it")
+		}
+	}
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
-		os.Exit(1)
+		os.Exit(exitUsage)
 	}
 }
 
 func init() {
 
 	runFlags := rootCmd.Flags()
-	runFlags.StringVar(&runOpts.workDir, "workdir", ".", "set the location of the daemon's working directory")
+	runFlags.StringVar(&runOpts.workDir, "workdir", defaultWorkDir(), "the directory of the daemon's state: the token file, and the databases unless --data-dir is given")
+	runFlags.StringVar(&runOpts.dataDir, "data-dir", "", "the directory of the databases (default is --workdir)")
+	runFlags.StringVar(&runOpts.runtimeDir, "runtime-dir", "", "the directory of the pidfile and of the unix sockets given with relative paths (default is $XDG_RUNTIME_DIR/ariadne, or ariadne-<digest> for an other --workdir, or --workdir)")
 	runFlags.StringVar(&runOpts.logfile, "log-file", "", "specify logfile (default is STDOUT)")
 	runFlags.StringVar(&runOpts.loglevel, "log-level", "info|warn|error|fatal", "log level can be off, fatal, error, warn, info, debug, trace, and all. Use '|' operator to use multiple levels.")
-	runFlags.IntVarP(&runOpts.port, "port", "p", 9000, "The port number to listen on")
+	runFlags.IntVarP(&runOpts.port, "port", "p", 9000, "The port number to listen on, if --listen isn't given")
+	runFlags.StringVar(&runOpts.tlsCert, "tls-cert", "", "serve TCP over TLS with this certificate (PEM)")
+	runFlags.StringVar(&runOpts.tlsKey, "tls-key", "", "the private key of --tls-cert (PEM)")
+	runFlags.StringVar(&runOpts.clientCA, "client-ca", "", "require client certificates signed by the CAs of this file (PEM)")
+	runFlags.DurationVar(&runOpts.queryTimeout, "query-timeout", jsonrpc.DefaultQueryTimeout, "stop the queries running for longer, 0 means never")
+	runFlags.StringArrayVar(&runOpts.listen, "listen", nil, "where to serve the rpc server: unix:/path/to/socket[?mode=0660&group=name] (relative to --runtime-dir, 0600 by default) or [tcp:]host:port, can be repeated (default is :port)")
 
 	// Here you will define your flags and configuration settings.
 	// Cobra supports persistent flags, which, if defined here,
@@ -6,4 +6,6 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/rjeczalik/notify v0.9.2
 	github.com/spf13/cobra v1.1.1
-)
\ No newline at end of file
+	golang.org/x/sys v0.5.0
+	golang.org/x/text v0.13.0
+)
@@ -0,0 +1,129 @@
+package access
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path"
+)
+
+// Caller is the user on the other end of a Unix socket.
+type Caller struct {
+	Uid     uint32
+	Gids    []uint32 // the primary and the supplementary groups
+	Unknown bool     // the caller or its groups couldn't be found out, then it can list nothing
+}
+
+// Privileged reports whether the caller can see every file anyway.
+func (c Caller) Privileged() bool {
+	return c.Uid == 0 && !c.Unknown
+}
+
+// Perm is the permission bits and the ownership of a file, as they are in the index.
+type Perm struct {
+	Mode os.FileMode
+	Uid  uint32
+	Gid  uint32
+}
+
+const (
+	read = 04
+	exec = 01
+)
+
+// allows reports whether the caller has the wanted (read, exec) bits on the file.
+func (c Caller) allows(p Perm, want os.FileMode) bool {
+	bits := p.Mode.Perm()
+	switch {
+	case c.Uid == p.Uid:
+		bits >>= 6
+	case c.inGroup(p.Gid):
+		bits >>= 3
+	}
+	return bits&want == want
+}
+
+func (c Caller) inGroup(gid uint32) bool {
+	for _, g := range c.Gids {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// Checker tells which directories a caller can list. The permissions of the
+// directories come from lookup, which gets the path of a directory without
+// the trailing slash.
+type Checker struct {
+	caller      Caller
+	lookup      func(dir string) (Perm, bool)
+	traversable map[string]bool
+}
+
+func NewChecker(caller Caller, lookup func(dir string) (Perm, bool)) *Checker {
+	return &Checker{caller: caller, lookup: lookup, traversable: make(map[string]bool)}
+}
+
+// CanList reports whether the caller can see the names in dir (a path_to_file):
+// it can read dir, and search it and every directory above it.
+func (c *Checker) CanList(dir string) bool {
+	if c.caller.Privileged() {
+		return true
+	}
+	if c.caller.Unknown {
+		return false
+	}
+	dir = path.Clean(dir)
+	perm, ok := c.perm(dir)
+	return ok && c.caller.allows(perm, read) && c.canTraverse(dir)
+}
+
+func (c *Checker) canTraverse(dir string) bool {
+	if can, in := c.traversable[dir]; in {
+		return can
+	}
+	perm, ok := c.perm(dir)
+	can := ok && c.caller.allows(perm, exec)
+	if can && dir != "/" {
+		can = c.canTraverse(path.Dir(dir))
+	}
+	c.traversable[dir] = can
+	return can
+}
+
+// perm looks up the permissions of dir, or stats it if it's not in the index.
+func (c *Checker) perm(dir string) (Perm, bool) {
+	if perm, ok := c.lookup(dir); ok {
+		return perm, true
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return Perm{}, false
+	}
+	uid, gid, ok := Owner(info)
+	return Perm{info.Mode(), uid, gid}, ok
+}
+
+type contextKey struct{}
+
+// ConnContext is the ConnContext of an http.Server, which makes the callers on
+// Unix sockets known to the handlers, see FromRequest.
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	if unixConn, ok := conn.(*net.UnixConn); ok {
+		if caller, ok := peerCaller(unixConn); ok {
+			return context.WithValue(ctx, contextKey{}, caller)
+		}
+	}
+	return ctx
+}
+
+// FromRequest returns the caller who sent req through a Unix socket, or nil if
+// it's unknown, e.g. because it came through TCP.
+func FromRequest(req *http.Request) *Caller {
+	if caller, ok := req.Context().Value(contextKey{}).(Caller); ok {
+		return &caller
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package access
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCanList(t *testing.T) {
+	perms := map[string]Perm{
+		"/":             {os.ModeDir | 0755, 0, 0},
+		"/home":         {os.ModeDir | 0755, 0, 0},
+		"/home/me":      {os.ModeDir | 0750, 1000, 1000},
+		"/home/me/pub":  {os.ModeDir | 0755, 1000, 1000},
+		"/home/you":     {os.ModeDir | 0700, 1001, 1001},
+		"/home/group":   {os.ModeDir | 0750, 0, 50},
+		"/home/noentry": {os.ModeDir | 0744, 0, 0},
+	}
+	lookup := func(dir string) (Perm, bool) {
+		p, ok := perms[dir]
+		return p, ok
+	}
+	tests := []struct {
+		caller Caller
+		dir    string
+		want   bool
+	}{
+		{Caller{Uid: 1000, Gids: []uint32{1000}}, "/home/me/pub/", true},
+		{Caller{Uid: 1000, Gids: []uint32{1000}}, "/home/you/", false},
+		{Caller{Uid: 1001, Gids: []uint32{1001}}, "/home/me/pub/", false},
+		{Caller{Uid: 1001, Gids: []uint32{1001, 1000}}, "/home/me/pub/", true},
+		{Caller{Uid: 1001, Gids: []uint32{1001, 50}}, "/home/group/", true},
+		// readable, but it can't be searched
+		{Caller{Uid: 1001, Gids: []uint32{1001}}, "/home/noentry/", false},
+		{Caller{Uid: 0}, "/home/you/", true},
+		// the caller whose groups couldn't be looked up
+		{Caller{Uid: 1000, Gids: []uint32{1000}, Unknown: true}, "/home/me/pub/", false},
+		{Caller{Uid: 0, Unknown: true}, "/home/", false},
+	}
+	for _, test := range tests {
+		if got := NewChecker(test.caller, lookup).CanList(test.dir); got != test.want {
+			t.Errorf("%+v can list %s: %v, want %v", test.caller, test.dir, got, test.want)
+		}
+	}
+}
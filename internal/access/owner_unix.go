@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package access
+
+import (
+	"os"
+	"syscall"
+)
+
+// Owner returns the owner user and group of the file.
+func Owner(info os.FileInfo) (uint32, uint32, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint32(st.Uid), uint32(st.Gid), true
+}
@@ -0,0 +1,64 @@
+package access
+
+import (
+	"fmt"
+	"net"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/logger"
+)
+
+// PeerCredentials tells whether the callers on Unix sockets can be identified.
+const PeerCredentials = true
+
+// peerCaller identifies the process on the other end of conn with SO_PEERCRED.
+// A caller who can't be identified is Unknown.
+func peerCaller(conn *net.UnixConn) (Caller, bool) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return Caller{Unknown: true}, true
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil || credErr != nil {
+		logger.InfoLog("WARNING: access -> the caller is unknown:", err, credErr)
+		return Caller{Unknown: true}, true
+	}
+
+	caller := Caller{Uid: cred.Uid, Gids: []uint32{cred.Gid}}
+	groups, err := userGroups(cred.Uid)
+	if err != nil {
+		logger.InfoLog("WARNING: access -> the groups of the caller with uid", cred.Uid, "are unknown:", err)
+		caller.Unknown = true
+		return caller, true
+	}
+	caller.Gids = append(caller.Gids, groups...)
+	return caller, true
+}
+
+// userGroups returns the groups of the user in the group database. The groups
+// of the calling process aren't read from /proc, its pid may be of an other
+// process by then.
+func userGroups(uid uint32) ([]uint32, error) {
+	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		return nil, err
+	}
+	ids, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	gids := make([]uint32, 0, len(ids))
+	for _, id := range ids {
+		gid, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gid %q of %s", id, u.Username)
+		}
+		gids = append(gids, uint32(gid))
+	}
+	return gids, nil
+}
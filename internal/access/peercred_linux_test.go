@@ -0,0 +1,54 @@
+package access
+
+import (
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestPeerCaller(t *testing.T) {
+	ln, err := net.Listen("unix", filepath.Join(t.TempDir(), "test.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("unix", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	caller, ok := peerCaller(conn.(*net.UnixConn))
+	if !ok || caller.Unknown || caller.Uid != uint32(os.Getuid()) {
+		t.Fatalf("the caller is %+v, want the uid %d", caller, os.Getuid())
+	}
+	// the groups come from the group database, not from the process
+	u, err := user.LookupId(strconv.Itoa(os.Getuid()))
+	if err != nil {
+		t.Skip("the user isn't in the user database:", err)
+	}
+	ids, _ := u.GroupIds()
+	want := map[uint32]bool{uint32(os.Getgid()): true}
+	for _, id := range ids {
+		gid, _ := strconv.ParseUint(id, 10, 32)
+		want[uint32(gid)] = true
+	}
+	got := make(map[uint32]bool)
+	for _, gid := range caller.Gids {
+		if !want[gid] {
+			t.Errorf("the caller is in the group %d, which isn't one of its user", gid)
+		}
+		got[gid] = true
+	}
+	if len(got) != len(want) {
+		t.Errorf("the caller is in the groups %v, want %v", caller.Gids, want)
+	}
+}
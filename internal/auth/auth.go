@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/logger"
+)
+
+// Scope is a set of rpc methods a token can call.
+type Scope string
+
+const (
+	SearchScope Scope = "search" // the searches
+	ManageScope Scope = "manage" // adding and removing watched dirs and saved searches
+	AdminScope  Scope = "admin"  // everything, including stopping the daemon
+)
+
+// Token is what the holder of a token is allowed to do.
+type Token struct {
+	Scopes []Scope
+	Id     string // tells the tokens apart without telling them, a digest of the token
+}
+
+// Grants reports whether the token can call the methods of scope.
+func (t Token) Grants(scope Scope) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == AdminScope {
+			return true
+		}
+	}
+	return false
+}
+
+// Tokens are the tokens of the token file. The file has a token and its comma
+// separated scopes in each line, e.g.
+//
+//	# token                            scopes
+//	3f9c0a6e1d2b4c5a8e7f9d0c1b2a3e4f   search,manage
+//
+// Lines starting with '#' are comments.
+type Tokens struct {
+	path   string
+	mu     sync.RWMutex
+	tokens map[string]Token
+}
+
+// LoadOrCreate reads the token file, or creates it with a new admin token if it doesn't exist.
+func LoadOrCreate(path string) (*Tokens, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := create(path); err != nil {
+			return nil, err
+		}
+		logger.InfoLog("auth -> token file created with an admin token:", path)
+	}
+
+	t := &Tokens{path: path}
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func create(path string) error {
+	token, err := NewToken()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(f, "# token scopes (%s, %s, %s)\n%s %s\n", SearchScope, ManageScope, AdminScope, token, AdminScope)
+	return f.Close()
+}
+
+// NewToken returns a random token.
+func NewToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Reload reads the token file again.
+func (t *Tokens) Reload() error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err == nil && info.Mode().Perm()&0077 != 0 {
+		logger.InfoLog("WARNING: the token file can be read by others:", t.path)
+	}
+
+	tokens := make(map[string]Token)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("auth: %s:%d: expected a token and its scopes", t.path, n)
+		}
+		digest := sha256.Sum256([]byte(fields[0]))
+		token := Token{Id: hex.EncodeToString(digest[:8])}
+		for _, s := range strings.Split(fields[1], ",") {
+			switch scope := Scope(s); scope {
+			case SearchScope, ManageScope, AdminScope:
+				token.Scopes = append(token.Scopes, scope)
+			default:
+				return fmt.Errorf("auth: %s:%d: unknown scope %q", t.path, n, s)
+			}
+		}
+		tokens[fields[0]] = token
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.tokens = tokens
+	t.mu.Unlock()
+	return nil
+}
+
+// Lookup returns the scopes of the token, and whether it's known.
+func (t *Tokens) Lookup(token string) (Token, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var found Token
+	ok := false
+	// compare with every token in constant time, so the timing doesn't leak them
+	for known, tok := range t.tokens {
+		if subtle.ConstantTimeCompare([]byte(known), []byte(token)) == 1 {
+			found, ok = tok, true
+		}
+	}
+	return found, ok
+}
+
+// FromRequest looks up the token of the "Authorization: Bearer <token>" header of req.
+func (t *Tokens) FromRequest(req *http.Request) (Token, bool) {
+	const prefix = "Bearer "
+	h := req.Header.Get("Authorization")
+	if !strings.HasPrefix(h, prefix) {
+		return Token{}, false
+	}
+	return t.Lookup(strings.TrimSpace(h[len(prefix):]))
+}
+
+// Header returns the value of the Authorization header carrying token.
+func Header(token string) string {
+	return "Bearer " + token
+}
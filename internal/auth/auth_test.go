@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// newTokens is a token file with the given lines.
+func newTokens(t *testing.T, lines ...string) *Tokens {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := LoadOrCreate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+func TestLoadOrCreate(t *testing.T) {
+	workDir := t.TempDir()
+	path := filepath.Join(workDir, "tokens")
+	tokens, err := LoadOrCreate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Windows has no permission bits for the others
+	if perm := info.Mode().Perm(); runtime.GOOS != "windows" && perm != 0600 {
+		t.Errorf("the token file was created with the mode %o", perm)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(line, "#") && line != "" {
+			fields = strings.Fields(line)
+		}
+	}
+	if len(fields) != 2 || fields[1] != string(AdminScope) {
+		t.Fatalf("the token file is %q, want an admin token", b)
+	}
+	if token, ok := tokens.Lookup(fields[0]); !ok || !reflect.DeepEqual(token.Scopes, []Scope{AdminScope}) {
+		t.Errorf("the created token is %+v, %v", token, ok)
+	}
+
+	// an existing file is kept
+	if err := ioutil.WriteFile(path, []byte("secret search\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err = LoadOrCreate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tokens.Lookup(fields[0]); ok {
+		t.Error("the token file was created again")
+	}
+	if _, ok := tokens.Lookup("secret"); !ok {
+		t.Error("the token of the existing file is unknown")
+	}
+}
+
+func TestReloadErrors(t *testing.T) {
+	for _, content := range []string{
+		"secret",
+		"secret search extra",
+		"secret find",
+		"secret search,",
+	} {
+		path := filepath.Join(t.TempDir(), "tokens")
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadOrCreate(path); err == nil {
+			t.Errorf("the token file %q was loaded", content)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	tokens := newTokens(t, "# a comment", "", "secret search,manage", "other admin")
+
+	token, ok := tokens.Lookup("secret")
+	if !ok || !reflect.DeepEqual(token.Scopes, []Scope{SearchScope, ManageScope}) {
+		t.Errorf("secret is %+v, %v", token, ok)
+	}
+	if other, _ := tokens.Lookup("other"); other.Id == token.Id || strings.Contains(token.Id, "secret") {
+		t.Errorf("the ids %q and %q of the tokens tell them", token.Id, other.Id)
+	}
+
+	for _, bad := range []string{"", "secre", "secret2", "SECRET", "# a comment", "search"} {
+		if token, ok := tokens.Lookup(bad); ok {
+			t.Errorf("the bad token %q was accepted as %+v", bad, token)
+		}
+	}
+
+	// a reloaded file drops the tokens it doesn't have any more
+	if err := ioutil.WriteFile(tokens.path, []byte("other admin\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := tokens.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tokens.Lookup("secret"); ok {
+		t.Error("the removed token is still accepted")
+	}
+}
+
+func TestFromRequest(t *testing.T) {
+	tokens := newTokens(t, "secret search")
+	for _, test := range []struct {
+		header string
+		ok     bool
+	}{
+		{"", false},
+		{"secret", false},
+		{"Basic secret", false},
+		{"Bearer", false},
+		{"Bearer ", false},
+		{"Bearer wrong", false},
+		{"bearer secret", false},
+		{Header("secret"), true},
+		{"Bearer secret ", true},
+	} {
+		req := httptest.NewRequest("POST", "/", nil)
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+		if _, ok := tokens.FromRequest(req); ok != test.ok {
+			t.Errorf("the header %q was accepted: %v", test.header, ok)
+		}
+	}
+}
+
+func TestGrants(t *testing.T) {
+	scopes := []Scope{SearchScope, ManageScope, AdminScope}
+	for _, held := range scopes {
+		token := Token{Scopes: []Scope{held}}
+		for _, wanted := range scopes {
+			if want := held == wanted || held == AdminScope; token.Grants(wanted) != want {
+				t.Errorf("a token of the %s scope grants the %s scope: %v", held, wanted, !want)
+			}
+		}
+	}
+	if (Token{}).Grants(SearchScope) {
+		t.Error("a token without scopes grants the search scope")
+	}
+}
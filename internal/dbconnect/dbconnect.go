@@ -1,12 +1,18 @@
 package dbconnect
 
 import (
+	"context"
 	"database/sql"
-	"log"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ariadne-tools/ariadne-daemon/internal/logger"
+	"github.com/ariadne-tools/ariadne-daemon/internal/metrics"
 	"github.com/ariadne-tools/ariadne-daemon/internal/terminator"
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -16,20 +22,29 @@ type Query struct {
 	Args []interface{}
 }
 
+var (
+	lockWait      = metrics.NewHistogram("ariadne_db_lock_wait_seconds", "Time spent waiting for the lock of the db connector.", metrics.DefBuckets, "db")
+	commitLatency = metrics.NewHistogram("ariadne_db_commit_duration_seconds", "Duration of the commits of the periodic writer.", metrics.DefBuckets, "db")
+	batchSize     = metrics.NewHistogram("ariadne_db_commit_batch_size", "Statements committed at once by the periodic writer.", []float64{1, 10, 100, 1000, 10000, 100000}, "db")
+)
+
 type DbConnector struct {
-	sync.Mutex
+	sem    chan struct{} // the lock of the connector, a channel so a query can stop waiting for it
 	DB     *sql.DB
+	name   string // the base name of the file, for the metrics
 	update time.Duration
 	qry    chan Query
 	wg     *sync.WaitGroup
+
+	lastCommit int64 // UnixNano, accessed atomically
 }
 
 func NewDbConnector(filename string, updatePeriod time.Duration, wg *sync.WaitGroup) *DbConnector {
 
-	dbConn, _ := sql.Open("sqlite3", filename)
+	dbConn, _ := sql.Open(driverName, filename)
 	qry := make(chan Query)
 
-	conn := DbConnector{DB: dbConn, update: updatePeriod, qry: qry, wg: wg}
+	conn := DbConnector{sem: make(chan struct{}, 1), DB: dbConn, name: filepath.Base(filename), update: updatePeriod, qry: qry, wg: wg, lastCommit: time.Now().UnixNano()}
 	if updatePeriod != 0 {
 		go conn.__dbWriterPeriodic()
 		wg.Add(1)
@@ -38,62 +53,183 @@ func NewDbConnector(filename string, updatePeriod time.Duration, wg *sync.WaitGr
 	return &conn
 }
 
-// TODO: ezt szebben, errorokkal?
-func (conn *DbConnector) Query(query string, args ...interface{}) [][]interface{} {
+// IsBusy tells whether a query failed because the db was locked. The messages
+// are checked, since the errors of the driver aren't defined without cgo.
+func IsBusy(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "database is locked") || strings.Contains(msg, "database table is locked")
+}
 
-	res := [][]interface{}{}
-	conn.Lock()
-	if rows, err := conn.DB.Query(query, args...); err != nil {
-		log.Fatal("query -> ", conn.DB, ", ", query, ", ", args, ", ", err)
-	} else {
-		defer rows.Close()
-		cols, _ := rows.Columns() // don't have to check for error, 'cos rows are not closed per se
-
-		for rows.Next() {
-			r := make([]interface{}, len(cols))
-			rp := make([]interface{}, len(cols))
-
-			for i := range r {
-				rp[i] = &r[i]
-			}
+// ErrMultipleRows is returned by QueryRow if the query has more than one row.
+var ErrMultipleRows = errors.New("got more than one row, expected at most one")
+
+// Query returns the rows of the query, each with the values of its columns.
+func (conn *DbConnector) Query(query string, args ...interface{}) ([][]interface{}, error) {
+	return conn.QueryContext(context.Background(), query, args...)
+}
+
+// QueryContext is like Query, but the query is interrupted when ctx is done,
+// or it's not started if that happens while it waits for the lock of the
+// connector. Then the rows read until that are returned, with the error of ctx.
+func (conn *DbConnector) QueryContext(ctx context.Context, query string, args ...interface{}) ([][]interface{}, error) {
+	if err := conn.lockContext(ctx); err != nil {
+		return nil, fmt.Errorf("query %q: %w", query, err)
+	}
+	defer conn.Unlock()
+
+	rows, err := conn.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		// the driver may fail with an error of its own when it's interrupted
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, fmt.Errorf("query %q: %w", query, err)
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
 
-			err := rows.Scan(rp...)
-			if err != nil {
-				log.Fatal("query -> ", err)
-			} else {
-				res = append(res, r)
+	res := [][]interface{}{}
+	for rows.Next() {
+		r := make([]interface{}, len(cols))
+		rp := make([]interface{}, len(cols))
+		for i := range r {
+			rp[i] = &r[i]
+		}
+		if err := rows.Scan(rp...); err != nil {
+			if ctx.Err() != nil {
+				return res, fmt.Errorf("query %q: %w", query, ctx.Err())
 			}
+			return nil, fmt.Errorf("query %q: %w", query, err)
+		}
+		res = append(res, r)
+	}
+	if err := rows.Err(); err != nil {
+		if ctx.Err() != nil {
+			return res, fmt.Errorf("query %q: %w", query, ctx.Err())
 		}
+		return nil, fmt.Errorf("query %q: %w", query, err)
 	}
+	return res, nil
+}
+
+// QueryRow is like Query for the queries having at most one row. It returns an
+// empty slice if there's none.
+func (conn *DbConnector) QueryRow(query string, args ...interface{}) ([]interface{}, error) {
+	return conn.QueryRowContext(context.Background(), query, args...)
+}
 
-	conn.Unlock()
-	return res
+// QueryRowContext is like QueryRow, but the query is interrupted when ctx is done.
+func (conn *DbConnector) QueryRowContext(ctx context.Context, query string, args ...interface{}) ([]interface{}, error) {
+	r, err := conn.QueryContext(ctx, query, args...)
+	switch {
+	case err != nil:
+		return nil, err
+	case len(r) == 0:
+		return []interface{}{}, nil
+	case len(r) == 1:
+		return r[0], nil
+	default:
+		return nil, fmt.Errorf("query %q: %w", query, ErrMultipleRows)
+	}
 }
 
-// TODO: ezt szebben, errorokkal?
-func (conn *DbConnector) QueryRow(query string, args ...interface{}) []interface{} {
-	r := conn.Query(query, args...)
-	if len(r) == 0 {
-		return []interface{}{}
-	} else if len(r) == 1 {
-		return r[0]
-	} else {
-		log.Fatal("dbConnector.queryRow -> got more than one row, expected at most one")
-		return []interface{}{}
+// Scan copies the values of a row returned by Query into dest, which are
+// *int64, *int, *bool (from an integer) or *string. It fails instead of
+// panicking if a value has an other type, e.g. it's NULL.
+func Scan(row []interface{}, dest ...interface{}) error {
+	if len(row) < len(dest) {
+		return fmt.Errorf("scan: %d columns, want %d", len(row), len(dest))
+	}
+	for i, d := range dest {
+		var ok bool
+		switch d := d.(type) {
+		case *int64:
+			*d, ok = row[i].(int64)
+		case *int:
+			var v int64
+			v, ok = row[i].(int64)
+			*d = int(v)
+		case *bool:
+			var v int64
+			v, ok = row[i].(int64)
+			*d = v != 0
+		case *string:
+			*d, ok = row[i].(string)
+		default:
+			return fmt.Errorf("scan: can't scan into %T", d)
+		}
+		if !ok {
+			return fmt.Errorf("scan: column %d is %T %v, can't scan it into %T", i, row[i], row[i], d)
+		}
 	}
+	return nil
 }
 
-func (conn *DbConnector) Exec(q string, args ...interface{}) {
+// Exec runs the statement by the writer of the connector. If it's periodic,
+// the statement is queued, and its errors are only logged. Otherwise it's run
+// right away, and its error is returned.
+func (conn *DbConnector) Exec(q string, args ...interface{}) error {
 
 	qry := Query{q, args}
 
 	if conn.update == 0 {
-		conn.__dbWriterInstant(qry)
-	} else {
-		conn.qry <- qry
+		return conn.__dbWriterInstant(qry)
+	}
+	conn.qry <- qry
+	return nil
+}
+
+// Lock locks the connector, for the statements run on DB directly.
+func (conn *DbConnector) Lock() {
+	conn.sem <- struct{}{}
+}
+
+// Unlock unlocks the connector.
+func (conn *DbConnector) Unlock() {
+	<-conn.sem
+}
+
+// lock locks the connector, and measures how long it took.
+func (conn *DbConnector) lock() {
+	conn.lockContext(context.Background())
+}
+
+// lockContext is like lock, but it stops waiting and returns the error of ctx
+// when ctx is done.
+func (conn *DbConnector) lockContext(ctx context.Context) error {
+	start := time.Now()
+	select {
+	case conn.sem <- struct{}{}:
+		lockWait.Observe(time.Since(start).Seconds(), conn.name)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stalled tells how long ago the periodic writer committed last, if it's
+// been more than stallAfter. The writes of the other connectors are never stalled.
+func (conn *DbConnector) Stalled(stallAfter time.Duration) (time.Duration, bool) {
+	if conn.update == 0 {
+		return 0, false
 	}
+	since := time.Since(time.Unix(0, atomic.LoadInt64(&conn.lastCommit)))
+	return since, since > stallAfter
 }
 
+// The periodic writer retries a commit while the db is locked, after a
+// backoff growing from retryMin to retryMax. Meanwhile the writes wait, and
+// Stalled tells that it doesn't commit. When the daemon stops, it gives up
+// after stopCommitRetries.
+const (
+	retryMin          = 100 * time.Millisecond
+	retryMax          = 5 * time.Second
+	stopCommitRetries = 10
+)
+
 // this function should not be called directly
 func (conn *DbConnector) __dbWriterPeriodic() {
 
@@ -105,75 +241,135 @@ func (conn *DbConnector) __dbWriterPeriodic() {
 		}
 	}()
 
+	// the transaction is run by BEGIN and COMMIT on a connection of its own,
+	// since a failed COMMIT can be retried, but a failed sql.Tx can't
+	ctx := context.Background()
+	var tx *sql.Conn
+	retry(func() (err error) {
+		tx, err = conn.DB.Conn(ctx)
+		return err
+	}, "__dbWriterPeriodic -> can't connect to the db:")
+
 	for {
-		tx, errBeg := conn.DB.Begin()
-		if errBeg != nil {
-			log.Fatal("__dbWriterPeriodic -> ", errBeg)
-		}
-		defer tx.Rollback() // The rollback will be ignored if the tx has been committed later in the function.
+		retry(func() error {
+			_, err := tx.ExecContext(ctx, "BEGIN")
+			return err
+		}, "__dbWriterPeriodic -> can't begin a transaction:")
+		batch := 0
 
 	TransactionLoop:
 		for {
 			select {
 			case q := <-conn.qry:
-				if _, err := tx.Exec(q.Base, q.Args...); err != nil {
-					log.Fatal("__dbWriterPeriodic", err)
+				if _, err := tx.ExecContext(ctx, q.Base, q.Args...); err != nil {
+					// only this statement is rolled back
+					logger.InfoLog("WARNING: __dbWriterPeriodic -> ", q.Base, q.Args, ": ", err)
+					continue
 				}
+				batch++
 			case <-commitSignal:
-				conn.Lock()
 				logger.DebugLog("__dbWriterPeriodic -> starting commit")
-				if errComm := tx.Commit(); errComm != nil {
-					log.Fatal("__dbWriterPeriodic -> commit error:", errComm)
-				} else {
-					logger.DebugLog("__dbWriterPeriodic -> commit done")
-					conn.Unlock()
+				start := time.Now()
+				if err := conn.commit(tx, -1); err != nil {
+					logger.InfoLog("ERROR: __dbWriterPeriodic -> the last", batch, "writes are lost:", err)
+					tx.ExecContext(ctx, "ROLLBACK")
 					break TransactionLoop
 				}
+				logger.DebugLog("__dbWriterPeriodic -> commit done")
+				commitLatency.Observe(time.Since(start).Seconds(), conn.name)
+				batchSize.Observe(float64(batch), conn.name)
+				atomic.StoreInt64(&conn.lastCommit, time.Now().UnixNano())
+				break TransactionLoop
 			case <-terminator.StopSig:
-				conn.Lock()
-				if errComm := tx.Commit(); errComm != nil {
-					log.Fatal("__dbWriterPeriodic -> commit error:", errComm)
+				if err := conn.commit(tx, stopCommitRetries); err != nil {
+					logger.InfoLog("ERROR: __dbWriterPeriodic -> the last", batch, "writes are lost:", err)
+					tx.ExecContext(ctx, "ROLLBACK")
 				} else {
 					logger.DebugLog("__dbWriterPeriodic -> everything's committed successfully, exiting...")
-					conn.Unlock()
-					conn.wg.Done()
-					return
 				}
+				tx.Close()
+				conn.wg.Done()
+				return
 			}
 		}
 	}
 }
 
+// commit commits the transaction of the periodic writer. It's retried while
+// the db is locked, at most attempts times unless that's negative. The
+// connector is unlocked between the attempts, so the queries aren't blocked.
+func (conn *DbConnector) commit(tx *sql.Conn, attempts int) error {
+	backoff := retryMin
+	for i := 1; ; i++ {
+		conn.lock()
+		_, err := tx.ExecContext(context.Background(), "COMMIT")
+		conn.Unlock()
+		if err == nil || !IsBusy(err) || i == attempts {
+			return err
+		}
+		logger.InfoLog("WARNING: __dbWriterPeriodic -> the db is locked, retrying the commit:", err)
+		sleep(&backoff)
+	}
+}
+
+// retry calls f until it succeeds, and logs its errors after msg.
+func retry(f func() error, msg string) {
+	backoff := retryMin
+	for err := f(); err != nil; err = f() {
+		logger.InfoLog("WARNING:", msg, err)
+		sleep(&backoff)
+	}
+}
+
+// sleep sleeps for backoff, and doubles it up to retryMax.
+func sleep(backoff *time.Duration) {
+	time.Sleep(*backoff)
+	if *backoff *= 2; *backoff > retryMax {
+		*backoff = retryMax
+	}
+}
+
 // this function should not be called directly
-func (conn *DbConnector) __dbWriterInstant(qry Query) {
+func (conn *DbConnector) __dbWriterInstant(qry Query) error {
 
-	conn.Lock()
+	conn.lock()
+	defer conn.Unlock()
 	if _, err := conn.DB.Exec(qry.Base, qry.Args...); err != nil {
-		log.Fatal("__dbWriterInstant -> ", err)
+		return fmt.Errorf("exec %q: %w", qry.Base, err)
 	}
-	conn.Unlock()
+	return nil
 }
 
-func WatchedDirs(db *DbConnector) map[int]string {
+func WatchedDirs(db *DbConnector) (map[int]string, error) {
 
 	watched := make(map[int]string)
 
-	dirs := db.Query("SELECT id, path_to_dir FROM watched_dirs_states")
+	dirs, err := db.Query("SELECT id, path_to_dir FROM watched_dirs_states")
+	if err != nil {
+		return nil, err
+	}
 	for _, dir := range dirs {
-		id := int(dir[0].(int64))
-		path := dir[1].(string)
+		var id int
+		var path string
+		if err := Scan(dir, &id, &path); err != nil {
+			return nil, fmt.Errorf("watched dir with an invalid id or path: %v", err)
+		}
 		watched[id] = path
 	}
-	return watched
+	return watched, nil
 }
 
-func WatchedIds(db *DbConnector) map[int]struct{} {
+func WatchedIds(db *DbConnector) (map[int]struct{}, error) {
 
 	m := make(map[int]struct{})
 
-	for id := range WatchedDirs(db) {
+	dirs, err := WatchedDirs(db)
+	if err != nil {
+		return nil, err
+	}
+	for id := range dirs {
 		m[id] = struct{}{}
 	}
 	logger.DebugLog("watchedIds -> the following ids have to be handled:", m)
-	return m
+	return m, nil
 }
@@ -0,0 +1,196 @@
+package dbconnect
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/textfold"
+	"golang.org/x/text/unicode/norm"
+)
+
+func TestScan(t *testing.T) {
+	var (
+		i64  int64
+		i    int
+		b    bool
+		s    string
+		rest string
+	)
+	if err := Scan([]interface{}{int64(7), int64(8), int64(1), "x", "y"}, &i64, &i, &b, &s); err != nil {
+		t.Fatal(err)
+	}
+	if i64 != 7 || i != 8 || !b || s != "x" {
+		t.Errorf("scanned %v %v %v %q", i64, i, b, s)
+	}
+
+	for _, row := range [][]interface{}{
+		{nil, int64(1), int64(1), "x", "y"},
+		{int64(1), "8", int64(1), "x", "y"},
+		{int64(1), int64(1), int64(1), []byte("x"), "y"},
+		{int64(1), int64(1), int64(1)},
+	} {
+		if err := Scan(row, &i64, &i, &b, &s, &rest); err == nil {
+			t.Errorf("scanned %v", row)
+		}
+	}
+	var f float64
+	if err := Scan([]interface{}{1.5}, &f); err == nil {
+		t.Errorf("scanned into a *float64")
+	}
+}
+
+func TestIsBusy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "files.db")
+	db := NewDbConnector(path+"?_busy_timeout=10", 0, nil)
+	defer db.DB.Close()
+	if err := db.Migrate(FilesMigrations); err != nil {
+		t.Fatal(err)
+	}
+
+	// an other connection holding the lock
+	other, err := sql.Open(driverName, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	tx, err := other.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("INSERT INTO files (dir_id, path_to_file, fname, size, mtime_ns, is_dir) VALUES (1, '/', 'a', 0, 0, 0)"); err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Exec("INSERT INTO files (dir_id, path_to_file, fname, size, mtime_ns, is_dir) VALUES (1, '/', 'b', 0, 0, 0)")
+	if err == nil || !IsBusy(err) {
+		t.Errorf("the write while the db is locked failed with %v", err)
+	}
+	if IsBusy(errors.New("no such table: files")) {
+		t.Errorf("an other error is taken for a locked db")
+	}
+}
+
+func TestQueryContextWaitsForLockUntilDone(t *testing.T) {
+	conn := NewDbConnector(filepath.Join(t.TempDir(), "test.db"), 0, nil)
+	defer conn.DB.Close()
+
+	// a slow query holding the lock
+	conn.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	rows, err := conn.QueryContext(ctx, "SELECT 1")
+	conn.Unlock()
+	if !errors.Is(err, context.DeadlineExceeded) || rows != nil {
+		t.Errorf("got %v, %v waiting for the lock past the deadline", rows, err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("waited %v for the lock", waited)
+	}
+
+	rows, err = conn.QueryContext(context.Background(), "SELECT 1")
+	if err != nil || len(rows) != 1 {
+		t.Errorf("got %v, %v once the lock is free", rows, err)
+	}
+}
+
+func TestWriterRetriesCommit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "files.db")
+	setup := NewDbConnector(path, 0, nil)
+	if err := setup.Migrate(FilesMigrations); err != nil {
+		t.Fatal(err)
+	}
+	setup.DB.Close()
+
+	// a reader holding the shared lock, so the commits fail with busy
+	other, err := sql.Open(driverName, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	read, err := other.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := read.QueryRow("SELECT count(*) FROM files").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := NewDbConnector(path+"?_busy_timeout=10", 20*time.Millisecond, new(sync.WaitGroup))
+	if err := conn.Exec("INSERT INTO files (dir_id, path_to_file, fname, size, mtime_ns, is_dir) VALUES (1, '/', 'a', 0, 0, 0)"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if _, stalled := conn.Stalled(200 * time.Millisecond); !stalled {
+		t.Errorf("the writer isn't stalled while the db is locked")
+	}
+
+	read.Rollback()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		// the writer may hold the lock in between its attempts
+		if err := other.QueryRow("SELECT count(*) FROM files").Scan(&n); err == nil && n == 1 {
+			break
+		} else if err != nil && !IsBusy(err) {
+			t.Fatal(err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the write wasn't committed once the db was unlocked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if since, stalled := conn.Stalled(time.Second); stalled {
+		t.Errorf("the writer is stalled for %v after it committed", since)
+	}
+}
+
+func TestMigrateBackfillsKeys(t *testing.T) {
+	db := NewDbConnector(filepath.Join(t.TempDir(), "files.db"), 0, nil)
+	defer db.DB.Close()
+	// the files indexed before the search keys
+	if err := db.Migrate(FilesMigrations[:1]); err != nil {
+		t.Fatal(err)
+	}
+	files := [][2]string{
+		{"/home/me/Árvíztűrő/", "Árvíztűrő.txt"},
+		{norm.NFD.String("/home/me/Árvíztűrő/"), norm.NFD.String("Árvíztűrő.txt")},
+		{"/home/me/", "README"},
+	}
+	for _, f := range files {
+		if err := db.Exec("INSERT INTO files (dir_id, path_to_file, fname, size, mtime_ns, is_dir) VALUES (1,?,?,0,0,0)", f[0], f[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Migrate(FilesMigrations); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		row, err := db.QueryRow("SELECT path_key, fname_key FROM files WHERE path_to_file=? AND fname=?", f[0], f[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pathKey, fnameKey string
+		if err := Scan(row, &pathKey, &fnameKey); err != nil {
+			t.Fatalf("%q: %v", f, err)
+		}
+		if pathKey != textfold.Key(f[0]) || fnameKey != textfold.Key(f[1]) {
+			t.Errorf("the keys of %q are %q, %q", f, pathKey, fnameKey)
+		}
+	}
+
+	rows, err := db.Query("SELECT fname FROM files WHERE path_key || fname_key = ?", "/home/me/arvizturo/arvizturo.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Errorf("the folded path matched %v", rows)
+	}
+}
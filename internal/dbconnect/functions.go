@@ -0,0 +1,63 @@
+package dbconnect
+
+import (
+	"database/sql"
+	"regexp"
+	"sync"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/textfold"
+	"github.com/mattn/go-sqlite3"
+)
+
+// driverName is the sqlite3 driver extended with the functions Ariadne's queries rely on.
+const driverName = "sqlite3_ariadne"
+
+const regexpCacheSize = 64
+
+var (
+	regexpCache = make(map[string]*regexp.Regexp)
+	regexpMu    sync.Mutex
+)
+
+func init() {
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if err := conn.RegisterFunc("regexp", regexpMatch, true); err != nil {
+				return err
+			}
+			return conn.RegisterFunc("ariadne_fold", textfold.Key, true)
+		},
+	})
+}
+
+// OpenScratch opens an empty in-memory db with the functions of the daemon, to
+// evaluate conditions of the search package outside of files.db.
+func OpenScratch() (*sql.DB, error) {
+	db, err := sql.Open(driverName, ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	// every connection would get an other in-memory db
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+// regexpMatch implements the "X REGEXP Y" operator, which SQLite calls as regexp(Y, X).
+func regexpMatch(pattern, s string) (bool, error) {
+	regexpMu.Lock()
+	re, in := regexpCache[pattern]
+	if !in {
+		var err error
+		if re, err = regexp.Compile(pattern); err != nil {
+			regexpMu.Unlock()
+			return false, err
+		}
+		if len(regexpCache) >= regexpCacheSize {
+			regexpCache = make(map[string]*regexp.Regexp)
+		}
+		regexpCache[pattern] = re
+	}
+	regexpMu.Unlock()
+
+	return re.MatchString(s), nil
+}
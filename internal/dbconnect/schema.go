@@ -0,0 +1,243 @@
+package dbconnect
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/logger"
+)
+
+// FilesMigrations upgrade files.db step by step: the i-th one brings the
+// schema from user_version i to i+1. Only append to the list!
+var FilesMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS "files" (
+		"dir_id"	INTEGER NOT NULL,
+		"path_to_file"	TEXT NOT NULL,
+		"fname"	TEXT NOT NULL,
+		"size"	INTEGER NOT NULL,
+		"ctime_ns"	INTEGER,
+		"mtime_ns"	INTEGER NOT NULL,
+		"is_dir" INTEGER NOT NULL,
+		PRIMARY KEY("path_to_file","fname")
+	);`,
+	// the search key of fname, see textfold.Key
+	`ALTER TABLE files ADD COLUMN fname_key TEXT;
+	UPDATE files SET fname_key = ariadne_fold(fname);`,
+	// the search key of path_to_file
+	`ALTER TABLE files ADD COLUMN path_key TEXT;
+	UPDATE files SET path_key = ariadne_fold(path_to_file);`,
+	// the permission bits and the owner, NULL until the next indexing
+	`ALTER TABLE files ADD COLUMN mode INTEGER;
+	ALTER TABLE files ADD COLUMN uid INTEGER;
+	ALTER TABLE files ADD COLUMN gid INTEGER;`,
+	// the change feed: every insert and update of a row gives it the next seq
+	// of files_seq, and every delete leaves a tombstone with the next seq
+	`ALTER TABLE files ADD COLUMN seq INTEGER NOT NULL DEFAULT 0;
+	UPDATE files SET seq = rowid;
+	CREATE INDEX files_seq_index ON files(seq);
+	CREATE TABLE files_seq (seq INTEGER NOT NULL);
+	INSERT INTO files_seq (seq) SELECT ifnull(max(seq), 0) FROM files;
+	CREATE TABLE files_tombstones (
+		"seq"	INTEGER PRIMARY KEY,
+		"dir_id"	INTEGER NOT NULL,
+		"path_to_file"	TEXT NOT NULL,
+		"fname"	TEXT NOT NULL
+	);
+	CREATE TRIGGER files_seq_insert AFTER INSERT ON files BEGIN
+		UPDATE files_seq SET seq = seq + 1;
+		UPDATE files SET seq = (SELECT seq FROM files_seq) WHERE rowid = new.rowid;
+	END;
+	CREATE TRIGGER files_seq_update AFTER UPDATE OF size, mtime_ns, is_dir, mode, uid, gid ON files
+	WHEN old.size IS NOT new.size OR old.mtime_ns IS NOT new.mtime_ns OR old.is_dir IS NOT new.is_dir
+		OR old.mode IS NOT new.mode OR old.uid IS NOT new.uid OR old.gid IS NOT new.gid
+	BEGIN
+		UPDATE files_seq SET seq = seq + 1;
+		UPDATE files SET seq = (SELECT seq FROM files_seq) WHERE rowid = new.rowid;
+	END;
+	CREATE TRIGGER files_seq_delete AFTER DELETE ON files BEGIN
+		UPDATE files_seq SET seq = seq + 1;
+		INSERT INTO files_tombstones (seq, dir_id, path_to_file, fname) VALUES ((SELECT seq FROM files_seq), old.dir_id, old.path_to_file, old.fname);
+		DELETE FROM files_tombstones WHERE seq <= (SELECT seq FROM files_seq) - ` + strconv.Itoa(TombstoneWindow) + `;
+	END;`,
+	// the seq of the latest tombstone pruned, the changes since an earlier seq
+	// can't be told any more. The tombstones pruned so far were older than the
+	// ones left, and at least TombstoneWindow older than the latest one.
+	`ALTER TABLE files_seq ADD COLUMN pruned INTEGER NOT NULL DEFAULT 0;
+	UPDATE files_seq SET pruned = ifnull((SELECT max(0, min(min(seq) - 1, max(seq) - ` + strconv.Itoa(TombstoneWindow) + `)) FROM files_tombstones), 0);
+	DROP TRIGGER files_seq_delete;
+	CREATE TRIGGER files_seq_delete AFTER DELETE ON files BEGIN
+		UPDATE files_seq SET seq = seq + 1;
+		INSERT INTO files_tombstones (seq, dir_id, path_to_file, fname) VALUES ((SELECT seq FROM files_seq), old.dir_id, old.path_to_file, old.fname);
+		UPDATE files_seq SET pruned = max(pruned, ifnull((SELECT max(seq) FROM files_tombstones WHERE seq <= files_seq.seq - ` + strconv.Itoa(TombstoneWindow) + `), 0));
+		DELETE FROM files_tombstones WHERE seq <= (SELECT seq FROM files_seq) - ` + strconv.Itoa(TombstoneWindow) + `;
+	END;`,
+	// the rows of a watched dir, for the indexing, the wiping and the metrics
+	`CREATE INDEX IF NOT EXISTS files_dir_id_index ON files(dir_id);`,
+	// the number of the rows of every watched dir, so the metrics don't count them
+	`CREATE TABLE files_dir_rows (
+		"dir_id"	INTEGER PRIMARY KEY,
+		"rows"	INTEGER NOT NULL
+	);
+	INSERT INTO files_dir_rows (dir_id, rows) SELECT dir_id, count(*) FROM files GROUP BY dir_id;
+	CREATE TRIGGER files_dir_rows_insert AFTER INSERT ON files BEGIN
+		INSERT INTO files_dir_rows (dir_id, rows) VALUES (new.dir_id, 1) ON CONFLICT(dir_id) DO UPDATE SET rows = rows + 1;
+	END;
+	CREATE TRIGGER files_dir_rows_delete AFTER DELETE ON files BEGIN
+		UPDATE files_dir_rows SET rows = rows - 1 WHERE dir_id = old.dir_id;
+		DELETE FROM files_dir_rows WHERE dir_id = old.dir_id AND rows <= 0;
+	END;
+	CREATE TRIGGER files_dir_rows_update AFTER UPDATE OF dir_id ON files WHEN old.dir_id IS NOT new.dir_id BEGIN
+		UPDATE files_dir_rows SET rows = rows - 1 WHERE dir_id = old.dir_id;
+		DELETE FROM files_dir_rows WHERE dir_id = old.dir_id AND rows <= 0;
+		INSERT INTO files_dir_rows (dir_id, rows) VALUES (new.dir_id, 1) ON CONFLICT(dir_id) DO UPDATE SET rows = rows + 1;
+	END;`,
+}
+
+// TombstoneWindow is the number of the latest changes the tombstones of deleted
+// rows are kept for. It's baked into the migrations of files_tombstones.
+const TombstoneWindow = 1000000
+
+// WatchedMigrations upgrade watched_dirs.db the same way. The first one is the
+// schema of watched_dirs.db.sql, so it's a no-op on dbs created from that.
+var WatchedMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS "process_states" (
+		"id"	INTEGER NOT NULL UNIQUE,
+		"state"	TEXT NOT NULL UNIQUE,
+		PRIMARY KEY("id" AUTOINCREMENT)
+	);
+	CREATE TABLE IF NOT EXISTS "watched_dirs" (
+		"id"	INTEGER NOT NULL UNIQUE,
+		"path_to_dir"	TEXT NOT NULL UNIQUE,
+		"state_id"	INTEGER NOT NULL,
+		PRIMARY KEY("id" AUTOINCREMENT)
+	);
+	INSERT OR IGNORE INTO "process_states" ("id","state") VALUES (1,'indexing');
+	INSERT OR IGNORE INTO "process_states" ("id","state") VALUES (2,'wiping');
+	INSERT OR IGNORE INTO "process_states" ("id","state") VALUES (3,'updating');
+	CREATE VIEW IF NOT EXISTS "watched_dirs_states" AS SELECT
+		watched_dirs.id,
+		watched_dirs.path_to_dir,
+		process_states.state as state
+	FROM
+		watched_dirs
+	INNER JOIN process_states ON watched_dirs.state_id = process_states.id;`,
+	// the live searches, see savedsearch.Notifier
+	`CREATE TABLE IF NOT EXISTS "saved_searches" (
+		"id"	INTEGER NOT NULL UNIQUE,
+		"name"	TEXT NOT NULL,
+		"request"	TEXT NOT NULL,
+		PRIMARY KEY("id" AUTOINCREMENT)
+	);`,
+}
+
+// trigramSchema is the FTS5 index of the search keys of filenames, kept in sync with the files table by triggers.
+// The rowids of files are stable, since the daemon never vacuums the db.
+var trigramSchema = []string{
+	`CREATE VIRTUAL TABLE files_fts USING fts5(fname_key, content='files', tokenize='trigram')`,
+	`CREATE TRIGGER files_fts_insert AFTER INSERT ON files BEGIN
+		INSERT INTO files_fts(rowid, fname_key) VALUES (new.rowid, new.fname_key);
+	END`,
+	`CREATE TRIGGER files_fts_delete AFTER DELETE ON files BEGIN
+		INSERT INTO files_fts(files_fts, rowid, fname_key) VALUES ('delete', old.rowid, old.fname_key);
+	END`,
+	`CREATE TRIGGER files_fts_update AFTER UPDATE OF fname_key ON files BEGIN
+		INSERT INTO files_fts(files_fts, rowid, fname_key) VALUES ('delete', old.rowid, old.fname_key);
+		INSERT INTO files_fts(rowid, fname_key) VALUES (new.rowid, new.fname_key);
+	END`,
+	`INSERT INTO files_fts(files_fts) VALUES ('rebuild')`,
+}
+
+var trigramTriggers = []string{"files_fts_insert", "files_fts_delete", "files_fts_update"}
+
+// Migrate applies the migrations the db hasn't seen yet, each in its own transaction.
+// It has to be called before the db is used by anything else.
+func (conn *DbConnector) Migrate(migrations []string) error {
+	conn.Lock()
+	defer conn.Unlock()
+
+	var version int
+	if err := conn.DB.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		logger.InfoLog("migrate -> upgrading schema to version", version+1)
+		tx, err := conn.DB.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration to version %d: %v", version+1, err)
+		}
+		// PRAGMA doesn't take parameters
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnableTrigram creates the trigram index of the filenames if it's missing or
+// outdated, and reports whether it can be used. It's false if SQLite was built
+// without FTS5 (the sqlite_fts5 build tag).
+func (conn *DbConnector) EnableTrigram() bool {
+	conn.Lock()
+	defer conn.Unlock()
+
+	var current string
+	var triggers int
+	conn.DB.QueryRow("SELECT sql FROM sqlite_master WHERE name='files_fts'").Scan(&current)
+	conn.DB.QueryRow("SELECT count(*) FROM sqlite_master WHERE type='trigger' AND name GLOB 'files_fts_*'").Scan(&triggers)
+	if current == trigramSchema[0] && triggers == len(trigramTriggers) {
+		_, err := conn.DB.Exec("SELECT rowid FROM files_fts LIMIT 0")
+		if err == nil {
+			return true
+		}
+		conn.disableTrigram(err)
+		return false
+	}
+
+	logger.InfoLog("enableTrigram -> building the trigram index of filenames, it can take a while...")
+	if err := conn.createTrigram(); err != nil {
+		conn.disableTrigram(err)
+		return false
+	}
+	logger.InfoLog("enableTrigram -> trigram index is ready")
+	return true
+}
+
+// disableTrigram drops the triggers of an index built earlier, which would make every write fail.
+func (conn *DbConnector) disableTrigram(reason error) {
+	logger.InfoLog("WARNING: trigram index is not available:", reason)
+	for _, trigger := range trigramTriggers {
+		conn.DB.Exec("DROP TRIGGER IF EXISTS " + trigger)
+	}
+}
+
+func (conn *DbConnector) createTrigram() error {
+	tx, err := conn.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, trigger := range trigramTriggers {
+		if _, err := tx.Exec("DROP TRIGGER IF EXISTS " + trigger); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DROP TABLE IF EXISTS files_fts"); err != nil {
+		return err
+	}
+	for _, stmt := range trigramSchema {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
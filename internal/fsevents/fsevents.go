@@ -0,0 +1,98 @@
+package fsevents
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/logger"
+)
+
+// Op is the kind of a change of a file.
+type Op string
+
+const (
+	Created  Op = "created"
+	Modified Op = "modified"
+	Removed  Op = "removed"
+	Renamed  Op = "renamed" // moved from OldPath/OldFname within the same watched dir
+)
+
+// Ops are all the kinds of changes.
+var Ops = []Op{Created, Modified, Removed, Renamed}
+
+// Change is a change of an indexed file, as the procHandlers applied it to the
+// files table. The size, mtime and type of a removed file are the ones it was
+// last indexed with, or zero if they are unknown, e.g. because it was indexed
+// after the last commit of files.db.
+type Change struct {
+	Op      Op
+	DirId   int
+	Path    string // path_to_file, ending with a slash
+	Fname   string
+	Size    int64
+	MtimeNs int64
+	IsDir   bool
+	Time    time.Time // when the change was applied
+
+	OldPath  string // only for Renamed
+	OldFname string
+}
+
+// Bus passes the changes of the files to the subscribers. A nil *Bus drops everything.
+type Bus struct {
+	mu   sync.Mutex
+	subs map[chan Change]uint64 // the changes dropped for each subscriber, see Dropped
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: make(map[chan Change]uint64)}
+}
+
+// Subscribe returns a channel receiving every change published from now on.
+// The changes are dropped while the buffer of the channel is full, so a slow
+// subscriber can't hold up the procHandlers, see Dropped.
+func (b *Bus) Subscribe(buffer int) chan Change {
+	c := make(chan Change, buffer)
+	b.mu.Lock()
+	b.subs[c] = 0
+	b.mu.Unlock()
+	return c
+}
+
+// Dropped returns how many changes were dropped for c since the last call,
+// because its buffer was full.
+func (b *Bus) Dropped(c chan Change) uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	dropped, in := b.subs[c]
+	if in {
+		b.subs[c] = 0
+	}
+	return dropped
+}
+
+// Unsubscribe stops sending changes to c and closes it.
+func (b *Bus) Unsubscribe(c chan Change) {
+	b.mu.Lock()
+	if _, in := b.subs[c]; in {
+		delete(b.subs, c)
+		close(c)
+	}
+	b.mu.Unlock()
+}
+
+func (b *Bus) Publish(change Change) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.subs {
+		select {
+		case c <- change:
+		default:
+			b.subs[c]++
+			logger.DebugLog("bus.publish -> subscriber is lagging behind, change dropped:", change.Path, change.Fname)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package fsevents
+
+import "testing"
+
+func TestDropped(t *testing.T) {
+	bus := NewBus()
+	c := bus.Subscribe(2)
+	other := bus.Subscribe(10)
+	for i := 0; i < 5; i++ {
+		bus.Publish(Change{Op: Created, Fname: "f"})
+	}
+	if got := bus.Dropped(c); got != 3 {
+		t.Errorf("%d changes dropped, want 3", got)
+	}
+	if got := bus.Dropped(c); got != 0 {
+		t.Errorf("%d changes dropped after Dropped, want 0", got)
+	}
+	if got := bus.Dropped(other); got != 0 || len(other) != 5 {
+		t.Errorf("the subscriber with room got %d changes, %d dropped", len(other), got)
+	}
+
+	bus.Unsubscribe(c)
+	if got := bus.Dropped(c); got != 0 {
+		t.Errorf("%d changes dropped after Unsubscribe", got)
+	}
+}
@@ -7,8 +7,10 @@ import (
 	"time"
 
 	"github.com/ariadne-tools/ariadne-daemon/internal/dbconnect"
+	"github.com/ariadne-tools/ariadne-daemon/internal/fsevents"
 	"github.com/ariadne-tools/ariadne-daemon/internal/logger"
 	"github.com/ariadne-tools/ariadne-daemon/internal/prochandler"
+	"github.com/ariadne-tools/ariadne-daemon/internal/progress"
 	"github.com/ariadne-tools/ariadne-daemon/internal/terminator"
 )
 
@@ -21,7 +23,7 @@ func isValidDir(path string) bool {
 }
 
 // ProcHandlerGenerator a comment...
-func ProcHandlerGenerator(watcheddb *dbconnect.DbConnector, filesdb *dbconnect.DbConnector, wg *sync.WaitGroup) {
+func ProcHandlerGenerator(watcheddb *dbconnect.DbConnector, filesdb *dbconnect.DbConnector, events *fsevents.Bus, tracker *progress.Tracker, wg *sync.WaitGroup) {
 	wg.Add(1)
 	defer wg.Done()
 
@@ -37,19 +39,26 @@ func ProcHandlerGenerator(watcheddb *dbconnect.DbConnector, filesdb *dbconnect.D
 			delete(handledIds, id)
 			logger.DebugLog("processTracker -> process with id", id, "removed:", handledIds)
 		default:
-			for dirID, dirPath := range dbconnect.WatchedDirs(watcheddb) {
+			dirs, err := dbconnect.WatchedDirs(watcheddb)
+			if err != nil {
+				logger.InfoLog("WARNING: procHandlerGenerator -> cannot read the watched dirs:", err)
+				continue
+			}
+			for dirID, dirPath := range dirs {
 				if isValidDir(dirPath) {
 					// if this directory wasn't handled before
 					if _, in := handledIds[dirID]; !in {
 						logger.DebugLog("procHandlerGenerator -> new procHandler created with id:", dirID)
 						handledIds[dirID] = struct{}{}
-						ph := prochandler.ProcHandler{dirID, watcheddb, filesdb, doneID}
+						ph := prochandler.ProcHandler{DirId: dirID, Watcheddb: watcheddb, Filesdb: filesdb, DoneID: doneID, Events: events, Progress: tracker}
 						go ph.Handle()
 					}
 				} else {
 					// the dir was deleted since last run, so delete it from the dbs as well
 					log.Printf("WARNING: The directory '%s' disappeared since last run, so now it's removed from Ariadne as well!\n", dirPath)
-					watcheddb.Exec("UPDATE watched_dirs SET state_id=? WHERE id=?", 2, dirID)
+					if err := watcheddb.Exec("UPDATE watched_dirs SET state_id=? WHERE id=?", 2, dirID); err != nil {
+						logger.InfoLog("WARNING: procHandlerGenerator -> can't remove the dir", dirID, ":", err)
+					}
 				}
 			}
 		}
@@ -0,0 +1,93 @@
+package jsonrpc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/dbconnect"
+	"github.com/ariadne-tools/ariadne-daemon/internal/logger"
+)
+
+// Kind is the kind of an error of a method of RemoteCall. The messages of the
+// errors start with their kind, like "not found: ...", so that the clients of
+// net/rpc, which only get the messages, can tell them apart too.
+type Kind string
+
+const (
+	InvalidArgument Kind = "invalid argument" // the request is wrong, retrying won't help
+	NotFound        Kind = "not found"        // a dir or saved search given doesn't exist
+	Busy            Kind = "busy"             // the db is locked, try again later
+	Internal        Kind = "internal"         // the daemon failed, see its log
+	Canceled        Kind = "canceled"         // the query timed out, or the client canceled its search
+)
+
+var kinds = []Kind{InvalidArgument, NotFound, Busy, Internal, Canceled}
+
+// The JSON-RPC error codes of the kinds, besides the ones of the specification.
+const (
+	CodeNotFound = -32004
+	CodeBusy     = -32005
+	CodeCanceled = -32006
+)
+
+// CallError is an error returned by a method of RemoteCall.
+type CallError struct {
+	Kind Kind
+	Err  error
+}
+
+func (e *CallError) Error() string {
+	return string(e.Kind) + ": " + e.Err.Error()
+}
+
+func (e *CallError) Unwrap() error {
+	return e.Err
+}
+
+func callErrorf(kind Kind, format string, args ...interface{}) error {
+	return &CallError{kind, fmt.Errorf(format, args...)}
+}
+
+// dbError is the error of a failed query: Busy if the db was locked, Internal
+// otherwise. The details of the internal errors are only logged.
+func dbError(err error) error {
+	if dbconnect.IsBusy(err) {
+		return &CallError{Busy, errors.New("the database is locked")}
+	}
+	logger.InfoLog("WARNING: remoteCall ->", err)
+	return &CallError{Internal, errors.New("database error")}
+}
+
+// ErrorKind tells the kind of an error returned by a call, e.g. an
+// rpc.ServerError. It's empty if the error has no kind.
+func ErrorKind(err error) Kind {
+	var callErr *CallError
+	if errors.As(err, &callErr) {
+		return callErr.Kind
+	}
+	for _, kind := range kinds {
+		if strings.HasPrefix(err.Error(), string(kind)+": ") {
+			return kind
+		}
+	}
+	return ""
+}
+
+// errorCode is the JSON-RPC error code of the message of an error.
+func errorCode(message string) int {
+	switch ErrorKind(errors.New(message)) {
+	case InvalidArgument:
+		return CodeInvalidParams
+	case NotFound:
+		return CodeNotFound
+	case Busy:
+		return CodeBusy
+	case Internal:
+		return CodeInternalError
+	case Canceled:
+		return CodeCanceled
+	default:
+		return CodeServerError
+	}
+}
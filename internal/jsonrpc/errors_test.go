@@ -0,0 +1,38 @@
+package jsonrpc
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"testing"
+)
+
+func TestErrorKind(t *testing.T) {
+	for _, kind := range kinds {
+		err := callErrorf(kind, "details")
+		if got := ErrorKind(fmt.Errorf("wrapped: %w", err)); got != kind {
+			t.Errorf("ErrorKind of %v is %q", err, got)
+		}
+		// what the clients of net/rpc get
+		if got := ErrorKind(rpc.ServerError(err.Error())); got != kind {
+			t.Errorf("ErrorKind of the message %q is %q", err, got)
+		}
+	}
+	if got := ErrorKind(rpc.ServerError("not a kind: details")); got != "" {
+		t.Errorf("ErrorKind of an error without a kind is %q", got)
+	}
+}
+
+func TestDbError(t *testing.T) {
+	busy := dbError(fmt.Errorf("exec: %w", errors.New("database is locked")))
+	if ErrorKind(busy) != Busy || errorCode(busy.Error()) != CodeBusy {
+		t.Errorf("a locked db is %v", busy)
+	}
+	internal := dbError(errors.New("no such table: files"))
+	if ErrorKind(internal) != Internal || errorCode(internal.Error()) != CodeInternalError {
+		t.Errorf("a failed query is %v", internal)
+	}
+	if internal.Error() != "internal: database error" {
+		t.Errorf("the details of a failed query are told to the client: %v", internal)
+	}
+}
@@ -0,0 +1,130 @@
+package jsonrpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/access"
+	"github.com/ariadne-tools/ariadne-daemon/internal/auth"
+	"github.com/ariadne-tools/ariadne-daemon/internal/fsevents"
+)
+
+const (
+	EventsBuffer      = 1024             // the changes waiting to be sent to a client
+	keepaliveInterval = 30 * time.Second // proxies tend to close idle connections
+)
+
+// NewEventsHandler streams the changes published on bus to the clients as
+// Server-Sent Events. The event type is the Op of the change, and the data is
+// the change in JSON. The clients need a token of the search scope, and the
+// callers on Unix sockets only get the changes of the files they could list.
+//
+// The query parameters filter the changes: prefix is a directory the files
+// have to be in (at any depth), and types is a comma separated list of the
+// wanted Ops, e.g. /events?prefix=/home/me/src&types=created,renamed
+func NewEventsHandler(bus *fsevents.Bus, r RemoteCall) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token, ok := r.Tokens.FromRequest(req)
+		if !ok {
+			http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+			return
+		}
+		if !token.Grants(auth.SearchScope) {
+			http.Error(w, fmt.Sprintf("the events need a token with the %s scope", auth.SearchScope), http.StatusForbidden)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		match, err := changeFilter(req.URL.Query().Get("prefix"), req.URL.Query().Get("types"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		caller := access.FromRequest(req)
+		if caller != nil && caller.Privileged() {
+			caller = nil
+		}
+
+		changes := bus.Subscribe(EventsBuffer)
+		defer bus.Unsubscribe(changes)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepalive := time.NewTicker(keepaliveInterval)
+		defer keepalive.Stop()
+
+		for id := 1; ; {
+			select {
+			case <-req.Context().Done():
+				return
+			case <-keepalive.C:
+				fmt.Fprint(w, ": keepalive\n\n")
+			case c, open := <-changes:
+				if !open {
+					return
+				}
+				if caller != nil {
+					// the permissions may change any time, so nothing is cached
+					var visible bool
+					if c, visible = visibleChange(access.NewChecker(*caller, r.dirPerm), c); !visible {
+						continue
+					}
+				}
+				if !match(c) {
+					continue
+				}
+				data, _ := json.Marshal(c)
+				fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, c.Op, data)
+				id++
+			}
+			flusher.Flush()
+		}
+	})
+}
+
+// changeFilter compiles the query parameters of the events into a function
+// telling which changes are wanted.
+func changeFilter(prefix, types string) (func(fsevents.Change) bool, error) {
+	if prefix != "" {
+		if !path.IsAbs(prefix) {
+			return nil, fmt.Errorf("the prefix %q is not absolute", prefix)
+		}
+		prefix = strings.TrimSuffix(path.Clean(prefix), "/") + "/"
+	}
+
+	ops := make(map[fsevents.Op]bool)
+	for _, t := range strings.Split(types, ",") {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		known := false
+		for _, op := range fsevents.Ops {
+			known = known || op == fsevents.Op(t)
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown event type %q, use %v", t, fsevents.Ops)
+		}
+		ops[fsevents.Op(t)] = true
+	}
+
+	below := func(dir, fname string) bool {
+		return strings.HasPrefix(dir+fname+"/", prefix)
+	}
+	return func(c fsevents.Change) bool {
+		if len(ops) > 0 && !ops[c.Op] {
+			return false
+		}
+		return below(c.Path, c.Fname) || c.Op == fsevents.Renamed && below(c.OldPath, c.OldFname)
+	}, nil
+}
@@ -0,0 +1,101 @@
+package jsonrpc
+
+import (
+	"os"
+	"path"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/access"
+	"github.com/ariadne-tools/ariadne-daemon/internal/dbconnect"
+	"github.com/ariadne-tools/ariadne-daemon/internal/fsevents"
+	"github.com/ariadne-tools/ariadne-daemon/internal/progress"
+)
+
+// replyFilter returns the function removing the files the caller couldn't
+// list from the replies of the searches and of Status, or nil if it can see
+// everything. The pages of the results may get shorter. Their cursors still
+// continue after the last row of the page, but they are sealed, so they don't
+// tell its name.
+func (r RemoteCall) replyFilter(caller *access.Caller) func(reply interface{}) {
+	if caller == nil || caller.Privileged() {
+		return nil
+	}
+	return func(reply interface{}) {
+		checker := access.NewChecker(*caller, r.dirPerm)
+		switch reply := reply.(type) {
+		case *[]FileProperties:
+			*reply = visibleFiles(checker, *reply)
+		case *SearchReply:
+			reply.Files = visibleFiles(checker, reply.Files)
+		case *HitsReply:
+			hits := reply.Hits[:0]
+			for _, h := range reply.Hits {
+				var visible bool
+				if h.Change, visible = visibleChange(checker, h.Change); visible {
+					hits = append(hits, h)
+				}
+			}
+			reply.Hits = hits
+		case *ChangesReply:
+			changes := reply.Changes[:0]
+			for _, c := range reply.Changes {
+				if checker.CanList(c.File.Path_to_file) {
+					changes = append(changes, c)
+				}
+			}
+			reply.Changes = changes
+		case *[]progress.Dir:
+			for i, d := range *reply {
+				if d.CurrentPath != "" && !checker.CanList(path.Dir(d.CurrentPath)) {
+					(*reply)[i].CurrentPath = ""
+				}
+			}
+		}
+	}
+}
+
+func visibleFiles(checker *access.Checker, files []FileProperties) []FileProperties {
+	visible := files[:0]
+	for _, f := range files {
+		if checker.CanList(f.Path_to_file) {
+			visible = append(visible, f)
+		}
+	}
+	return visible
+}
+
+// visibleChange returns the part of the change the checker's caller can see: a
+// file renamed from or to a directory it can't list was created or removed as
+// far as it knows.
+func visibleChange(checker *access.Checker, c fsevents.Change) (fsevents.Change, bool) {
+	visible := checker.CanList(c.Path)
+	if c.Op != fsevents.Renamed {
+		return c, visible
+	}
+
+	oldVisible := checker.CanList(c.OldPath)
+	switch {
+	case visible && !oldVisible:
+		c.Op, c.OldPath, c.OldFname = fsevents.Created, "", ""
+	case !visible && oldVisible:
+		c = fsevents.Change{Op: fsevents.Removed, DirId: c.DirId, Path: c.OldPath, Fname: c.OldFname, Time: c.Time}
+	}
+	return c, visible || oldVisible
+}
+
+// dirPerm looks up the permissions of a directory in the index.
+func (r RemoteCall) dirPerm(dir string) (access.Perm, bool) {
+	parent, name := path.Split(dir)
+	if name == "" {
+		return access.Perm{}, false
+	}
+	row, err := r.Filesdb.QueryRow("SELECT mode, uid, gid FROM files WHERE path_to_file=? AND fname=? AND mode IS NOT NULL AND uid IS NOT NULL", parent, name)
+	if err != nil || len(row) == 0 {
+		return access.Perm{}, false
+	}
+	var mode, uid, gid int64
+	if err := dbconnect.Scan(row, &mode, &uid, &gid); err != nil {
+		// a NULL gid, say, then the dir is looked up in the file system
+		return access.Perm{}, false
+	}
+	return access.Perm{Mode: os.FileMode(mode), Uid: uint32(uid), Gid: uint32(gid)}, true
+}
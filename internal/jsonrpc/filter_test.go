@@ -0,0 +1,128 @@
+package jsonrpc
+
+import (
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/access"
+	"github.com/ariadne-tools/ariadne-daemon/internal/dbconnect"
+	"github.com/ariadne-tools/ariadne-daemon/internal/fsevents"
+	"github.com/ariadne-tools/ariadne-daemon/internal/progress"
+)
+
+// testPerms are the dirs of the tests, the others don't exist as far as the
+// checker knows.
+var testPerms = map[string]access.Perm{
+	"/":                    {Mode: 0755},
+	"/ariadne":             {Mode: 0755},
+	"/ariadne/open":        {Mode: 0755},
+	"/ariadne/secret":      {Mode: 0700},
+	"/ariadne/secret/open": {Mode: 0755},
+}
+
+func newTestChecker() *access.Checker {
+	return access.NewChecker(access.Caller{Uid: 1000, Gids: []uint32{1000}}, func(dir string) (access.Perm, bool) {
+		perm, ok := testPerms[dir]
+		return perm, ok
+	})
+}
+
+func TestVisibleChange(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		change  fsevents.Change
+		want    fsevents.Change
+		visible bool
+	}{
+		{
+			fsevents.Change{Op: fsevents.Created, DirId: 1, Path: "/ariadne/open/", Fname: "a", Time: now},
+			fsevents.Change{Op: fsevents.Created, DirId: 1, Path: "/ariadne/open/", Fname: "a", Time: now},
+			true,
+		},
+		{
+			fsevents.Change{Op: fsevents.Modified, DirId: 1, Path: "/ariadne/secret/", Fname: "a", Time: now},
+			fsevents.Change{Op: fsevents.Modified, DirId: 1, Path: "/ariadne/secret/", Fname: "a", Time: now},
+			false,
+		},
+		{
+			// the dir can't be reached through the secret one
+			fsevents.Change{Op: fsevents.Removed, DirId: 1, Path: "/ariadne/secret/open/", Fname: "a", Time: now},
+			fsevents.Change{Op: fsevents.Removed, DirId: 1, Path: "/ariadne/secret/open/", Fname: "a", Time: now},
+			false,
+		},
+		{
+			fsevents.Change{Op: fsevents.Renamed, DirId: 1, Path: "/ariadne/open/", Fname: "b", OldPath: "/ariadne/open/", OldFname: "a", Time: now},
+			fsevents.Change{Op: fsevents.Renamed, DirId: 1, Path: "/ariadne/open/", Fname: "b", OldPath: "/ariadne/open/", OldFname: "a", Time: now},
+			true,
+		},
+		{
+			// moved out of sight: removed, without telling where
+			fsevents.Change{Op: fsevents.Renamed, DirId: 1, Path: "/ariadne/secret/", Fname: "b", Size: 10, OldPath: "/ariadne/open/", OldFname: "a", Time: now},
+			fsevents.Change{Op: fsevents.Removed, DirId: 1, Path: "/ariadne/open/", Fname: "a", Time: now},
+			true,
+		},
+		{
+			// moved into sight: created, without telling where from
+			fsevents.Change{Op: fsevents.Renamed, DirId: 1, Path: "/ariadne/open/", Fname: "b", Size: 10, OldPath: "/ariadne/secret/", OldFname: "a", Time: now},
+			fsevents.Change{Op: fsevents.Created, DirId: 1, Path: "/ariadne/open/", Fname: "b", Size: 10, Time: now},
+			true,
+		},
+		{
+			fsevents.Change{Op: fsevents.Renamed, DirId: 1, Path: "/ariadne/secret/", Fname: "b", OldPath: "/ariadne/secret/", OldFname: "a", Time: now},
+			fsevents.Change{Op: fsevents.Renamed, DirId: 1, Path: "/ariadne/secret/", Fname: "b", OldPath: "/ariadne/secret/", OldFname: "a", Time: now},
+			false,
+		},
+	}
+	for _, test := range tests {
+		got, visible := visibleChange(newTestChecker(), test.change)
+		if visible != test.visible {
+			t.Errorf("%+v is visible: %v, want %v", test.change, visible, test.visible)
+		}
+		if visible && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%+v is seen as %+v, want %+v", test.change, got, test.want)
+		}
+	}
+}
+
+func TestVisibleFiles(t *testing.T) {
+	files := []FileProperties{
+		{Path_to_file: "/ariadne/open/", Fname: "a"},
+		{Path_to_file: "/ariadne/secret/", Fname: "b"},
+		{Path_to_file: "/ariadne/secret/open/", Fname: "c"},
+		{Path_to_file: "/elsewhere/", Fname: "d"},
+		{Path_to_file: "/ariadne/", Fname: "open"},
+	}
+	want := []FileProperties{files[0], files[4]}
+	if got := visibleFiles(newTestChecker(), files); !reflect.DeepEqual(got, want) {
+		t.Errorf("visible files are %v, want %v", got, want)
+	}
+}
+
+func TestStatusFilter(t *testing.T) {
+	db := newFilesDb(t, dbconnect.FilesMigrations)
+	for _, d := range []struct {
+		path string
+		mode int
+	}{{"/ariadne", 0755}, {"/ariadne/open", 0755}, {"/ariadne/secret", 0700}} {
+		dir, name := path.Split(d.path)
+		mustExec(t, db, "INSERT INTO files (dir_id, path_to_file, fname, size, mtime_ns, is_dir, mode, uid, gid) VALUES (1,?,?,0,0,1,?,0,0)", dir, name, d.mode)
+	}
+	// without a gid, so looked up in the file system, where it doesn't exist
+	mustExec(t, db, "INSERT INTO files (dir_id, path_to_file, fname, size, mtime_ns, is_dir, mode, uid, gid) VALUES (1,'/ariadne/','nogid',0,0,1,511,0,NULL)")
+	filter := RemoteCall{Filesdb: db}.replyFilter(&access.Caller{Uid: 1000, Gids: []uint32{1000}})
+
+	status := []progress.Dir{
+		{DirId: 1, Path: "/ariadne/open", CurrentPath: "/ariadne/open/a"},
+		{DirId: 2, Path: "/ariadne/secret", CurrentPath: "/ariadne/secret/plans.txt"},
+		{DirId: 3, Path: "/ariadne", CurrentPath: ""},
+		{DirId: 4, Path: "/ariadne/nogid", CurrentPath: "/ariadne/nogid/a"},
+	}
+	filter(&status)
+	for i, want := range []string{"/ariadne/open/a", "", "", ""} {
+		if status[i].CurrentPath != want {
+			t.Errorf("the current path of %s is %q, want %q", status[i].Path, status[i].CurrentPath, want)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package jsonrpc
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/access"
+	"github.com/ariadne-tools/ariadne-daemon/internal/auth"
+)
+
+// connected is the status line rpc.DialHTTP expects.
+const connected = "200 Connected to Go RPC"
+
+// NewGobHandler serves server, where r is registered, to net/rpc clients, like
+// rpc.Server.ServeHTTP, but only to the ones with a token, and only the methods
+// the token grants. The callers on Unix sockets only get the files they could
+// list. Use DialHTTP to connect with a token.
+func NewGobHandler(server *rpc.Server, r RemoteCall) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodConnect {
+			w.Header().Set("Allow", http.MethodConnect)
+			http.Error(w, "405 must CONNECT", http.StatusMethodNotAllowed)
+			return
+		}
+		token, ok := r.Tokens.FromRequest(req)
+		if !ok {
+			http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		io.WriteString(conn, "HTTP/1.0 "+connected+"\n\n")
+		server.ServeCodec(&authCodec{ServerCodec: newGobServerCodec(conn), token: token, filter: r.replyFilter(access.FromRequest(req)), start: make(map[uint64]time.Time)})
+	})
+}
+
+// authCodec answers the requests of the methods the token doesn't grant
+// itself, so they never reach the server.
+type authCodec struct {
+	rpc.ServerCodec
+	token  auth.Token
+	filter func(reply interface{}) // see RemoteCall.replyFilter
+	method string                  // of the request whose body is read next
+	mu     sync.Mutex              // the server writes the responses concurrently
+	start  map[uint64]time.Time    // when the requests being served were read, by seq
+}
+
+func (c *authCodec) ReadRequestHeader(r *rpc.Request) error {
+	for {
+		if err := c.ServerCodec.ReadRequestHeader(r); err != nil {
+			return err
+		}
+		if err := authorize(c.token, r.ServiceMethod); err == nil {
+			c.method = r.ServiceMethod
+			c.mu.Lock()
+			c.start[r.Seq] = time.Now()
+			c.mu.Unlock()
+			return nil
+		} else if err := c.reject(r, err); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *authCodec) ReadRequestBody(x interface{}) error {
+	if err := c.ServerCodec.ReadRequestBody(x); err != nil {
+		return err
+	}
+	scopeSearchId(c.token, c.method, x)
+	return nil
+}
+
+func (c *authCodec) reject(r *rpc.Request, reason error) error {
+	observeCall(r.ServiceMethod, "forbidden", time.Time{})
+	if err := c.ServerCodec.ReadRequestBody(nil); err != nil {
+		return err
+	}
+	return c.WriteResponse(&rpc.Response{ServiceMethod: r.ServiceMethod, Seq: r.Seq, Error: reason.Error()}, struct{}{})
+}
+
+func (c *authCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if c.filter != nil && r.Error == "" {
+		c.filter(body)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if start, in := c.start[r.Seq]; in {
+		delete(c.start, r.Seq)
+		status := "ok"
+		if r.Error != "" {
+			status = "error"
+		}
+		observeCall(r.ServiceMethod, status, start)
+	}
+	return c.ServerCodec.WriteResponse(r, body)
+}
+
+// gobServerCodec is the codec of net/rpc, which it doesn't export.
+type gobServerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	closed bool
+}
+
+func newGobServerCodec(conn io.ReadWriteCloser) *gobServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &gobServerCodec{rwc: conn, dec: gob.NewDecoder(conn), enc: gob.NewEncoder(buf), encBuf: buf}
+}
+
+func (c *gobServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	return c.dec.Decode(r)
+}
+
+func (c *gobServerCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *gobServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if err := c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			// the header couldn't be encoded, so the stream is broken
+			c.Close()
+		}
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobServerCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
+
+// DialHTTP connects to the gob endpoint of the daemon at address ("unix" or
+// "tcp" network) with the token, like rpc.DialHTTP.
+func DialHTTP(network, address, token string) (*rpc.Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn, token)
+}
+
+// NewClient makes the CONNECT request of DialHTTP on an open connection.
+func NewClient(conn net.Conn, token string) (*rpc.Client, error) {
+	req, _ := http.NewRequest(http.MethodConnect, rpc.DefaultRPCPath, nil)
+	req.Host = "ariadne"
+	req.Header.Set("Authorization", auth.Header(token))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err == nil && resp.Status != connected {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
@@ -0,0 +1,105 @@
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/dbconnect"
+	"github.com/ariadne-tools/ariadne-daemon/internal/prochandler"
+)
+
+const (
+	dbCheckTimeout   = 2 * time.Second
+	WriterStallAfter = 30 * time.Second // the writer of files.db commits every few seconds
+	// the file system events a watched dir may have waiting to be applied
+	// before the daemon isn't ready, since its index lags behind by as many
+	// changes. They are queued without a limit, only the channel of notify
+	// loses events when it's full, see prochandler.UPDATE_BUFFER.
+	MaxPendingEvents = prochandler.UPDATE_BUFFER / 2
+)
+
+// HealthReply is the body of /healthz and /readyz: the status, and the result
+// of each check, "ok" or what's wrong.
+type HealthReply struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// NewHealthHandler serves /healthz: it's 200 if the daemon is alive and its dbs
+// can be read, 503 otherwise. It needs no token, for the supervisors.
+func NewHealthHandler(r RemoteCall) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		checks := map[string]string{
+			"files_db":        dbCheck(req.Context(), r.Filesdb),
+			"watched_dirs_db": dbCheck(req.Context(), r.Watcheddb),
+		}
+		writeHealth(w, checks, "ok", "failing")
+	})
+}
+
+// NewReadyHandler serves /readyz: it's 200 once every watched dir has been
+// indexed, while the writer of files.db commits and the dirs don't have too
+// many file system events waiting, 503 otherwise. It needs no token either.
+func NewReadyHandler(r RemoteCall) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		checks := map[string]string{"indexed": "ok", "writer": "ok", "events": "ok"}
+
+		var dirs []WatchedDirsState
+		if err := r.WatchedDirs(struct{}{}, &dirs); err != nil {
+			checks["indexed"] = err.Error()
+		}
+		indexed := make(map[int]bool)
+		pending := make(map[int]int)
+		for _, d := range r.Progress.Dirs() {
+			indexed[d.DirId], pending[d.DirId] = d.Indexed, d.PendingEvents
+		}
+		var notIndexed, backlogged []int
+		for _, d := range dirs {
+			if d.State != "wiping" && !indexed[d.Id] {
+				notIndexed = append(notIndexed, d.Id)
+			}
+			if pending[d.Id] >= MaxPendingEvents {
+				backlogged = append(backlogged, d.Id)
+			}
+		}
+		if len(notIndexed) > 0 {
+			checks["indexed"] = fmt.Sprintf("the first indexing of the dirs %v is running", notIndexed)
+		}
+		if len(backlogged) > 0 {
+			checks["events"] = fmt.Sprintf("the dirs %v have more than %d events waiting", backlogged, MaxPendingEvents)
+		}
+		if since, stalled := r.Filesdb.Stalled(WriterStallAfter); stalled {
+			checks["writer"] = fmt.Sprintf("the last commit was %s ago", since.Round(time.Second))
+		}
+
+		writeHealth(w, checks, "ready", "not ready")
+	})
+}
+
+// dbCheck reads the schema of the db, without waiting for the lock of the connector.
+func dbCheck(ctx context.Context, db *dbconnect.DbConnector) string {
+	ctx, cancel := context.WithTimeout(ctx, dbCheckTimeout)
+	defer cancel()
+	var n int
+	if err := db.DB.QueryRowContext(ctx, "SELECT count(*) FROM sqlite_master").Scan(&n); err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
+
+func writeHealth(w http.ResponseWriter, checks map[string]string, ok, failing string) {
+	reply := HealthReply{Status: ok, Checks: checks}
+	status := http.StatusOK
+	for _, result := range checks {
+		if result != "ok" {
+			reply.Status, status = failing, http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(reply)
+}
@@ -1,13 +1,69 @@
 package jsonrpc
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/access"
+	"github.com/ariadne-tools/ariadne-daemon/internal/auth"
 	"github.com/ariadne-tools/ariadne-daemon/internal/dbconnect"
+	"github.com/ariadne-tools/ariadne-daemon/internal/progress"
+	"github.com/ariadne-tools/ariadne-daemon/internal/savedsearch"
+	"github.com/ariadne-tools/ariadne-daemon/internal/search"
 	"github.com/ariadne-tools/ariadne-daemon/internal/terminator"
 )
 
+// APIVersion is the version of the methods of RemoteCall, as major.minor. The
+// minor version grows with the additions, so a client of a major version works
+// with any daemon of the same major version, as long as the methods and the
+// features it uses are listed by Capabilities.
+const APIVersion = "1.2"
+
 type RemoteCall struct {
+	Version   string // of the daemon, set at build time
 	Watcheddb *dbconnect.DbConnector
 	Filesdb   *dbconnect.DbConnector
+	Index     search.Index
+	Saved     *savedsearch.Notifier
+	Tokens    *auth.Tokens
+	Progress  *progress.Tracker
+	Queries   *Queries
+}
+
+// MethodScopes tells which scope of the tokens grants the methods of RemoteCall.
+// The methods missing from here need the admin scope.
+var MethodScopes = map[string]auth.Scope{
+	"Search":            auth.SearchScope,
+	"Find":              auth.SearchScope,
+	"SearchQuery":       auth.SearchScope,
+	"WatchedDirs":       auth.SearchScope,
+	"SavedSearches":     auth.SearchScope,
+	"SavedSearchHits":   auth.SearchScope,
+	"Changes":           auth.SearchScope,
+	"Status":            auth.SearchScope,
+	"Capabilities":      auth.SearchScope,
+	"Cancel":            auth.SearchScope,
+	"Add":               auth.ManageScope,
+	"Remove":            auth.ManageScope,
+	"Reindex":           auth.ManageScope,
+	"AddSavedSearch":    auth.ManageScope,
+	"RemoveSavedSearch": auth.ManageScope,
+}
+
+// authorize tells why the token can't call the method, if it can't.
+func authorize(token auth.Token, serviceMethod string) error {
+	scope, in := MethodScopes[strings.TrimPrefix(serviceMethod, "RemoteCall.")]
+	if !in {
+		scope = auth.AdminScope
+	}
+	if !token.Grants(scope) {
+		return fmt.Errorf("auth: %s needs a token with the %s scope", serviceMethod, scope)
+	}
+	return nil
 }
 
 type FileProperties struct {
@@ -16,6 +72,70 @@ type FileProperties struct {
 	Size         int
 	Mtime_ns     int
 	IsDir        bool
+	Score        float64 // only set by ranked searches
+}
+
+type SearchReply struct {
+	Files      []FileProperties
+	NextCursor string // empty if this is the last page
+	Truncated  bool   // there are, or there may be, more results than Files
+	TimedOut   bool   // the search ran out of time, so Files are the results found until then
+}
+
+type QueryRequest struct {
+	Query  string
+	Limit  int
+	Cursor string
+	Id     string // see search.Request
+}
+
+type SavedSearchRequest struct {
+	Name    string
+	Request search.Request
+}
+
+type HitsRequest struct {
+	Since  uint64 // the Next of the previous reply, 0 at first
+	Ids    []int  // the saved searches to watch, all of them if empty
+	WaitMs int    // how long to wait for new hits, at most savedsearch.MaxWait
+}
+
+type HitsReply struct {
+	Hits []savedsearch.Hit
+	Next uint64
+	Lost bool // some hits were dropped before they could be fetched, or never found, run the searches again
+}
+
+type ChangesRequest struct {
+	Since    int64 // the Next of the previous reply, 0 to fetch the whole index
+	Limit    int   // the most changes to return, search.DefaultLimit if zero
+	Snapshot int64 // the Snapshot of the previous reply, 0 if there was none
+}
+
+// FileChange is a row of files inserted or updated at Seq, or the tombstone of
+// one deleted at Seq, whose File has only its path and name.
+type FileChange struct {
+	Seq     int64
+	Deleted bool
+	File    FileProperties
+}
+
+type ChangesReply struct {
+	Changes []FileChange
+	Next    int64 // the Since of the next request
+	More    bool  // there are more changes after Next already
+	Resync  bool  // Since is too old or unknown, start over from 0
+	// the seq when the fetching of the whole index started: the files deleted
+	// earlier weren't returned, so their tombstones aren't needed
+	Snapshot int64
+}
+
+type CapabilitiesReply struct {
+	Version     string // of the daemon
+	APIVersion  string
+	SearchModes []search.Mode
+	Features    []string // the optional features enabled
+	Methods     []string
 }
 
 type WatchedDirsState struct {
@@ -24,18 +144,223 @@ type WatchedDirsState struct {
 	State string
 }
 
-func (r RemoteCall) Search(searchString string, files *[]FileProperties) error {
-	rows := r.Filesdb.Query("SELECT path_to_file,fname,size,mtime_ns,is_dir FROM files WHERE fname LIKE '%'||?||'%'", searchString)
+func fileProperties(row []interface{}) (FileProperties, error) {
+	var f FileProperties
+	err := dbconnect.Scan(row, &f.Path_to_file, &f.Fname, &f.Size, &f.Mtime_ns, &f.IsDir)
+	return f, err
+}
+
+// filesProperties converts the rows of files, see fileProperties.
+func filesProperties(rows [][]interface{}) ([]FileProperties, error) {
+	files := make([]FileProperties, 0, len(rows))
 	for _, row := range rows {
-		path_to_file := row[0].(string)
-		fname := row[1].(string)
-		size := int(row[2].(int64))
-		mtime_ns := int(row[3].(int64))
+		f, err := fileProperties(row)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// Search returns every file whose name contains searchString. It fails if it
+// times out, see Find for the searches returning partial results.
+func (r RemoteCall) Search(searchString string, files *[]FileProperties) error {
+	where, args, err := search.Request{Pattern: searchString}.Where(r.Index)
+	if err != nil {
+		return &CallError{InvalidArgument, err}
+	}
+	ctx, done, _ := r.Queries.start("")
+	defer done()
+	rows, err := r.Filesdb.QueryContext(ctx, "SELECT path_to_file,fname,size,mtime_ns,is_dir FROM files WHERE "+where, args...)
+	if err != nil {
+		_, err = queryError(err)
+		return err
+	}
+	found, err := filesProperties(rows)
+	if err != nil {
+		return dbError(err)
+	}
+	*files = append(*files, found...)
+	return nil
+}
+
+// Find is like Search, but the pattern is matched according to req.Mode, and
+// the results are returned page by page. If the search times out, the results
+// found until then are returned with TimedOut, and the next page continues
+// from them. A search with an Id can be canceled by Cancel.
+func (r RemoteCall) Find(req search.Request, reply *SearchReply) error {
+	q, args, err := req.Select("path_to_file,fname,size,mtime_ns,is_dir", r.Index)
+	if err != nil {
+		return &CallError{InvalidArgument, err}
+	}
+
+	ctx, done, err := r.Queries.start(req.Id)
+	if err != nil {
+		return err
+	}
+	defer done()
+	rows, err := r.Filesdb.QueryContext(ctx, q, args...)
+	if err != nil {
+		if reply.TimedOut, err = queryError(err); !reply.TimedOut {
+			return err
+		}
+		reply.Truncated = true
+	}
+	files, err := filesProperties(rows)
+	if err != nil {
+		return dbError(err)
+	}
+	if req.Mode == search.Ranked {
+		candidates := make([]search.Candidate, 0, len(files))
+		for i, f := range files {
+			candidates = append(candidates, search.Candidate{Path: f.Path_to_file, Fname: f.Fname, MtimeNs: int64(f.Mtime_ns), Row: rows[i]})
+		}
+		ranked, matches := search.Rank(req.Pattern, candidates, req.PageSize(), time.Now())
+		// more matches than the page, or the matches beyond MaxCandidates weren't scored
+		reply.Truncated = reply.Truncated || matches > len(ranked) || len(files) >= search.MaxCandidates
+		for _, c := range ranked {
+			f, _ := fileProperties(c.Row)
+			f.Score = c.Score
+			reply.Files = append(reply.Files, f)
+		}
+		return nil
+	}
+
+	if len(files) > req.PageSize() {
+		files = files[:req.PageSize()]
+		reply.Truncated = true
+	}
+	if reply.Truncated && len(files) > 0 {
+		last := files[len(files)-1]
+		reply.NextCursor = search.NextCursor(last.Path_to_file, last.Fname)
+	}
+	reply.Files = files
+	return nil
+}
+
+// SearchQuery searches for the files matching a query written in the query
+// language of the search package, e.g. "ext:go size:>10M -vendor (foo OR bar)".
+func (r RemoteCall) SearchQuery(req QueryRequest, reply *SearchReply) error {
+	if strings.TrimSpace(req.Query) == "" {
+		return callErrorf(InvalidArgument, "search: empty query")
+	}
+	return r.Find(search.Request{Query: req.Query, Limit: req.Limit, Cursor: req.Cursor, Id: req.Id}, reply)
+}
+
+// Cancel stops the running search with the id, and reports whether there was
+// one. The search fails with a Canceled error.
+func (r RemoteCall) Cancel(id string, canceled *bool) error {
+	if id == "" {
+		return callErrorf(InvalidArgument, "empty search id")
+	}
+	*canceled = r.Queries.cancel(id)
+	return nil
+}
+
+// AddSavedSearch saves a search, so that the files matching it are reported by
+// SavedSearchHits whenever they are created, modified or removed.
+func (r RemoteCall) AddSavedSearch(req SavedSearchRequest, id *int) error {
+	if _, _, err := req.Request.Where(search.Index{}); err != nil {
+		return &CallError{InvalidArgument, err}
+	}
+	var err error
+	if *id, err = r.Saved.Add(req.Name, req.Request); err != nil {
+		return dbError(err)
+	}
+	return nil
+}
+
+func (r RemoteCall) RemoveSavedSearch(id int, removed *bool) error {
+	var err error
+	if *removed, err = r.Saved.Remove(id); err != nil {
+		return dbError(err)
+	}
+	return nil
+}
 
-		is_dir_int := row[4].(int64)
-		is_dir := is_dir_int != 0
+func (r RemoteCall) SavedSearches(_ struct{}, searches *[]savedsearch.SavedSearch) error {
+	*searches = r.Saved.List()
+	return nil
+}
 
-		*files = append(*files, FileProperties{path_to_file, fname, size, mtime_ns, is_dir})
+// SavedSearchHits long-polls the hits of the saved searches: it returns as soon
+// as there are hits after req.Since, or when req.WaitMs elapses.
+func (r RemoteCall) SavedSearchHits(req HitsRequest, reply *HitsReply) error {
+	if req.WaitMs < 0 {
+		return callErrorf(InvalidArgument, "negative wait %d", req.WaitMs)
+	}
+	saved := make(map[int]struct{})
+	for _, s := range r.Saved.List() {
+		saved[s.Id] = struct{}{}
+	}
+	for _, id := range req.Ids {
+		if _, in := saved[id]; !in {
+			return callErrorf(NotFound, "no saved search with id %d", id)
+		}
+	}
+	reply.Hits, reply.Next, reply.Lost = r.Saved.Hits(req.Since, req.Ids, time.Duration(req.WaitMs)*time.Millisecond)
+	return nil
+}
+
+// Changes returns the changes of the index after req.Since, in the order they
+// were made. Starting from 0 it returns every file of the index and no
+// tombstones, so a mirror can be built by calling it with the Next and the
+// Snapshot of the previous reply until More is false, then kept up to date by
+// calling it again with the last ones.
+func (r RemoteCall) Changes(req ChangesRequest, reply *ChangesReply) error {
+	if req.Since < 0 || req.Limit < 0 || req.Snapshot < 0 {
+		return callErrorf(InvalidArgument, "changes: negative since, limit or snapshot")
+	}
+	limit := search.Request{Limit: req.Limit}.PageSize()
+
+	ctx, done, _ := r.Queries.start("")
+	defer done()
+	row, err := r.Filesdb.QueryRowContext(ctx, "SELECT seq, pruned FROM files_seq")
+	if err != nil {
+		_, err = queryError(err)
+		return err
+	}
+	var current, pruned int64
+	if err := dbconnect.Scan(row, &current, &pruned); err != nil {
+		return dbError(fmt.Errorf("invalid files_seq: %v", err))
+	}
+	reply.Snapshot = req.Snapshot
+	if req.Since == 0 {
+		reply.Snapshot = current
+	}
+	// the tombstones after Since are needed, but only the ones of the files
+	// deleted after the snapshot the mirror started from
+	tombstonesSince := req.Since
+	if reply.Snapshot > tombstonesSince {
+		tombstonesSince = reply.Snapshot
+	}
+	if req.Since > current || reply.Snapshot > current || req.Since > 0 && tombstonesSince < pruned {
+		reply.Next, reply.Snapshot, reply.Resync = current, 0, true
+		return nil
+	}
+
+	rows, err := r.Filesdb.QueryContext(ctx, `SELECT seq, 0, path_to_file, fname, size, mtime_ns, is_dir FROM files WHERE seq > ?
+		UNION ALL SELECT seq, 1, path_to_file, fname, 0, 0, 0 FROM files_tombstones WHERE seq > ? AND ? > 0
+		ORDER BY seq LIMIT ?`, req.Since, tombstonesSince, req.Since, limit+1)
+	if err != nil {
+		_, err = queryError(err)
+		return err
+	}
+	if len(rows) > limit {
+		rows, reply.More = rows[:limit], true
+	}
+	reply.Next = req.Since
+	for _, row := range rows {
+		var c FileChange
+		if err := dbconnect.Scan(row, &c.Seq, &c.Deleted); err != nil {
+			return dbError(err)
+		}
+		if c.File, err = fileProperties(row[2:]); err != nil {
+			return dbError(err)
+		}
+		reply.Changes = append(reply.Changes, c)
+		reply.Next = c.Seq
 	}
 	return nil
 }
@@ -45,13 +370,40 @@ func (r RemoteCall) StopDaemon(x struct{}, y *struct{}) error {
 	return nil
 }
 
+// Reload reads the token file again, so the changes of the tokens take effect.
+func (r RemoteCall) Reload(x struct{}, y *struct{}) error {
+	if err := r.Tokens.Reload(); err != nil {
+		return &CallError{Internal, err}
+	}
+	return nil
+}
+
+// Add watches the given dirs, which have to be absolute paths of existing
+// directories, and returns the ones that weren't watched yet.
 func (r RemoteCall) Add(dirpaths []string, added *[]string) error {
+	for _, dirpath := range dirpaths {
+		if !filepath.IsAbs(dirpath) {
+			return callErrorf(InvalidArgument, "%s is not an absolute path", dirpath)
+		}
+		if info, err := os.Stat(dirpath); err != nil {
+			return callErrorf(NotFound, "%s: %v", dirpath, err)
+		} else if !info.IsDir() {
+			return callErrorf(InvalidArgument, "%s is not a directory", dirpath)
+		}
+	}
 
-	q := r.Watcheddb.Query("SELECT path_to_dir FROM watched_dirs")
+	q, err := r.Watcheddb.Query("SELECT path_to_dir FROM watched_dirs")
+	if err != nil {
+		return dbError(err)
+	}
 	dirsAdded := make([]string, 0)
 
 	for _, v := range q {
-		dirsAdded = append(dirsAdded, v[0].(string))
+		var path string
+		if err := dbconnect.Scan(v, &path); err != nil {
+			return dbError(err)
+		}
+		dirsAdded = append(dirsAdded, path)
 	}
 
 	for _, dirpath := range dirpaths {
@@ -63,31 +415,127 @@ func (r RemoteCall) Add(dirpaths []string, added *[]string) error {
 			}
 		}
 		if !alreadyAdded {
-			r.Watcheddb.Exec("INSERT into watched_dirs (path_to_dir, state_id) VALUES (?,?)", dirpath, 1)
+			if err := r.Watcheddb.Exec("INSERT into watched_dirs (path_to_dir, state_id) VALUES (?,?)", dirpath, 1); err != nil {
+				return dbError(err)
+			}
 			*added = append(*added, dirpath)
+			dirsAdded = append(dirsAdded, dirpath)
 		}
 	}
 	return nil
 }
 
+// Remove stops watching the given dirs, and returns the ones that were watched.
 func (r RemoteCall) Remove(dirIds []int, removed *[]int) error {
-	watched := dbconnect.WatchedIds(r.Watcheddb)
+	watched, err := dbconnect.WatchedIds(r.Watcheddb)
+	if err != nil {
+		return dbError(err)
+	}
 	for _, dirId := range dirIds {
 		if _, in := watched[dirId]; in == true {
-			r.Watcheddb.Exec("UPDATE watched_dirs SET state_id=? WHERE id=?", 2, dirId) //TODO: 2-t cserelni
+			if err := r.Watcheddb.Exec("UPDATE watched_dirs SET state_id=? WHERE id=?", 2, dirId); err != nil { //TODO: 2-t cserelni
+				return dbError(err)
+			}
 			*removed = append(*removed, dirId)
 		}
 	}
 	return nil
 }
 
+// Reindex walks the given watched dirs again (all of them if dirIds is empty),
+// to catch up with the changes the events missed. The dirs being removed are skipped.
+func (r RemoteCall) Reindex(dirIds []int, reindexed *[]int) error {
+	dirs, err := r.Watcheddb.Query("SELECT id FROM watched_dirs_states WHERE state != 'wiping'")
+	if err != nil {
+		return dbError(err)
+	}
+	for _, dir := range dirs {
+		var id int
+		if err := dbconnect.Scan(dir, &id); err != nil {
+			return dbError(err)
+		}
+		if len(dirIds) > 0 && !containsInt(dirIds, id) {
+			continue
+		}
+		if err := r.Watcheddb.Exec("UPDATE watched_dirs SET state_id=? WHERE id=?", 1, id); err != nil {
+			return dbError(err)
+		}
+		*reindexed = append(*reindexed, id)
+	}
+	return nil
+}
+
+func containsInt(ints []int, i int) bool {
+	for _, v := range ints {
+		if v == i {
+			return true
+		}
+	}
+	return false
+}
+
 func (r RemoteCall) WatchedDirs(_ struct{}, watched *[]WatchedDirsState) error {
-	dirs := r.Watcheddb.Query("SELECT * FROM watched_dirs_states")
+	ctx, done, _ := r.Queries.start("")
+	defer done()
+	dirs, err := r.Watcheddb.QueryContext(ctx, "SELECT id, path_to_dir, state FROM watched_dirs_states")
+	if err != nil {
+		_, err = queryError(err)
+		return err
+	}
 	for _, dir := range dirs {
-		id := int(dir[0].(int64))
-		path := dir[1].(string)
-		state := dir[2].(string)
-		*watched = append(*watched, WatchedDirsState{id, path, state})
+		var d WatchedDirsState
+		if err := dbconnect.Scan(dir, &d.Id, &d.Path, &d.State); err != nil {
+			return dbError(err)
+		}
+		*watched = append(*watched, d)
+	}
+	return nil
+}
+
+// Status returns the progress of the watched dirs: how far their indexing got,
+// and how many file system events are waiting to be applied.
+func (r RemoteCall) Status(_ struct{}, status *[]progress.Dir) error {
+	tracked := make(map[int]progress.Dir)
+	for _, d := range r.Progress.Dirs() {
+		tracked[d.DirId] = d
+	}
+
+	var watched []WatchedDirsState
+	if err := r.WatchedDirs(struct{}{}, &watched); err != nil {
+		return err
+	}
+	for _, w := range watched {
+		d, in := tracked[w.Id]
+		if !in {
+			// its procHandler hasn't started yet
+			d = progress.Dir{DirId: w.Id, EstimatedRemainingFiles: -1, EstimatedRemainingMs: -1}
+		}
+		d.Path, d.State = w.Path, w.State
+		*status = append(*status, d)
+	}
+	return nil
+}
+
+// Capabilities tells what the daemon supports, so that the clients can check it
+// before relying on it.
+func (r RemoteCall) Capabilities(_ struct{}, reply *CapabilitiesReply) error {
+	reply.Version, reply.APIVersion = r.Version, APIVersion
+	if reply.Version == "" {
+		reply.Version = "devel"
+	}
+	reply.SearchModes = search.Modes
+
+	reply.Features = []string{"query_language", "saved_searches", "events", "changes", "status", "health", "metrics", "typed_errors", "cancel"}
+	if r.Index.Trigram {
+		reply.Features = append(reply.Features, "trigram_index")
+	}
+	if access.PeerCredentials {
+		reply.Features = append(reply.Features, "permission_filtering")
+	}
+
+	t := reflect.TypeOf(r)
+	for i := 0; i < t.NumMethod(); i++ {
+		reply.Methods = append(reply.Methods, t.Method(i).Name)
 	}
 	return nil
 }
@@ -0,0 +1,153 @@
+package jsonrpc
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/dbconnect"
+)
+
+// newFilesDb is an empty files.db with the migrations given.
+func newFilesDb(t *testing.T, migrations []string) *dbconnect.DbConnector {
+	t.Helper()
+	db := dbconnect.NewDbConnector(filepath.Join(t.TempDir(), "files.db"), 0, nil)
+	t.Cleanup(func() { db.DB.Close() })
+	if err := db.Migrate(migrations); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func mustExec(t *testing.T, db *dbconnect.DbConnector, q string, args ...interface{}) {
+	t.Helper()
+	if err := db.Exec(q, args...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func insertFiles(t *testing.T, db *dbconnect.DbConnector, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		mustExec(t, db, "INSERT INTO files (dir_id, path_to_file, fname, size, mtime_ns, is_dir) VALUES (1, '/d/', ?, 1, 1, 0)", name)
+	}
+}
+
+func seqs(t *testing.T, db *dbconnect.DbConnector) (current, pruned int64) {
+	t.Helper()
+	row, err := db.QueryRow("SELECT seq, pruned FROM files_seq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return row[0].(int64), row[1].(int64)
+}
+
+func TestTombstonesPruned(t *testing.T) {
+	db := newFilesDb(t, dbconnect.FilesMigrations)
+	insertFiles(t, db, "a", "b", "c")
+	mustExec(t, db, "DELETE FROM files WHERE fname = 'a'")
+	if _, pruned := seqs(t, db); pruned != 0 {
+		t.Fatalf("pruned is %d before anything was pruned", pruned)
+	}
+
+	// a million changes later
+	mustExec(t, db, "UPDATE files_seq SET seq = seq + ?", dbconnect.TombstoneWindow)
+	mustExec(t, db, "DELETE FROM files WHERE fname = 'b'")
+	current, pruned := seqs(t, db)
+	if pruned != 4 {
+		t.Errorf("pruned is %d, want 4, the seq of the tombstone of a", pruned)
+	}
+	rows, _ := db.Query("SELECT seq, fname FROM files_tombstones")
+	if len(rows) != 1 || rows[0][0].(int64) != current {
+		t.Errorf("the tombstones left are %v, want the one of b at %d", rows, current)
+	}
+}
+
+func TestPrunedOfEarlierDbs(t *testing.T) {
+	// the tombstones of the dbs of the version before pruned
+	db := newFilesDb(t, dbconnect.FilesMigrations[:5])
+	insertFiles(t, db, "a", "b", "c")
+	mustExec(t, db, "DELETE FROM files WHERE fname = 'a'")
+	mustExec(t, db, "UPDATE files_seq SET seq = seq + ?", dbconnect.TombstoneWindow+10)
+	mustExec(t, db, "DELETE FROM files WHERE fname = 'b'")
+	mustExec(t, db, "DELETE FROM files WHERE fname = 'c'")
+	if err := db.Migrate(dbconnect.FilesMigrations); err != nil {
+		t.Fatal(err)
+	}
+	current, pruned := seqs(t, db)
+	// the tombstone of a was pruned, which can't be told apart from the ones
+	// older than the window of the latest tombstone, c
+	if want := current - dbconnect.TombstoneWindow; pruned != want {
+		t.Errorf("pruned is %d, want %d", pruned, want)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	db := newFilesDb(t, dbconnect.FilesMigrations)
+	r := RemoteCall{Filesdb: db}
+	for i := 0; i < 10; i++ {
+		insertFiles(t, db, fmt.Sprint(i))
+	}
+	// a busy index: a lot of changes, and the tombstones of the early ones pruned
+	mustExec(t, db, "UPDATE files_seq SET seq = seq + ?, pruned = seq + ? - 100", 3*dbconnect.TombstoneWindow, 3*dbconnect.TombstoneWindow)
+	mustExec(t, db, "DELETE FROM files WHERE fname = '9'")
+	current, pruned := seqs(t, db)
+
+	// fetching the whole index page by page
+	var reply ChangesReply
+	if err := r.Changes(ChangesRequest{Since: 0, Limit: 4}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Resync || !reply.More || len(reply.Changes) != 4 || reply.Snapshot != current {
+		t.Fatalf("the first page is %+v", reply)
+	}
+	files := len(reply.Changes)
+	for reply.More {
+		mustExec(t, db, "DELETE FROM files WHERE fname = '8'")
+		req := ChangesRequest{Since: reply.Next, Limit: 4, Snapshot: reply.Snapshot}
+		reply = ChangesReply{}
+		if err := r.Changes(req, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Resync {
+			t.Fatalf("a page after %+v has to be fetched again from 0", req)
+		}
+		for _, c := range reply.Changes {
+			if c.Deleted && c.File.Fname != "8" {
+				t.Errorf("the tombstone of %s deleted before the snapshot is returned", c.File.Fname)
+			}
+			if !c.Deleted {
+				files++
+			}
+		}
+	}
+	if files != 8 {
+		t.Errorf("got %d files, want 8", files)
+	}
+
+	// a mirror of an earlier snapshot missed the pruned tombstones
+	reply = ChangesReply{}
+	if err := r.Changes(ChangesRequest{Since: pruned - 1}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if !reply.Resync {
+		t.Errorf("no resync after the tombstones since %d were pruned", pruned-1)
+	}
+	reply = ChangesReply{}
+	if err := r.Changes(ChangesRequest{Since: pruned}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Resync {
+		t.Errorf("resync, but no tombstones after %d were pruned", pruned)
+	}
+
+	for _, req := range []ChangesRequest{{Since: current + 10}, {Since: 5, Snapshot: current + 10}} {
+		reply = ChangesReply{}
+		if err := r.Changes(req, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if !reply.Resync {
+			t.Errorf("no resync for %+v, which is ahead of the db", req)
+		}
+	}
+}
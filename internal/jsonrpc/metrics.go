@@ -0,0 +1,101 @@
+package jsonrpc
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/auth"
+	"github.com/ariadne-tools/ariadne-daemon/internal/dbconnect"
+	"github.com/ariadne-tools/ariadne-daemon/internal/metrics"
+)
+
+var (
+	rpcRequests = metrics.NewCounter("ariadne_rpc_requests_total", "RPC requests by method and outcome (ok, error or forbidden).", "method", "status")
+	rpcDuration = metrics.NewHistogram("ariadne_rpc_duration_seconds", "Duration of the RPC requests by method.", metrics.DefBuckets, "method")
+)
+
+var dirStates = []string{"indexing", "updating", "wiping"}
+
+// rowsPerDir reads the rows of the watched dirs the triggers of files count.
+const rowsPerDir = "SELECT dir_id, rows FROM files_dir_rows"
+
+// observeCall counts a served request. The methods RemoteCall doesn't have are
+// counted together, so that the clients can't make up labels.
+func observeCall(serviceMethod, status string, start time.Time) {
+	method := strings.TrimPrefix(serviceMethod, "RemoteCall.")
+	if _, in := reflect.TypeOf(RemoteCall{}).MethodByName(method); !in {
+		method = "unknown"
+	}
+	rpcRequests.Inc(method, status)
+	if status != "forbidden" {
+		rpcDuration.Observe(time.Since(start).Seconds(), method)
+	}
+}
+
+// NewMetricsHandler serves /metrics in the text format of Prometheus. It needs
+// a token of the search scope, like the rest of what it tells about the dirs.
+func NewMetricsHandler(r RemoteCall) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token, ok := r.Tokens.FromRequest(req)
+		if !ok {
+			http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+			return
+		}
+		if !token.Grants(auth.SearchScope) {
+			http.Error(w, fmt.Sprintf("the metrics need a token with the %s scope", auth.SearchScope), http.StatusForbidden)
+			return
+		}
+
+		var dirs []WatchedDirsState
+		if err := r.WatchedDirs(struct{}{}, &dirs); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ctx, done, _ := r.Queries.start("")
+		counts, err := r.Filesdb.QueryContext(ctx, rowsPerDir)
+		done()
+		if err != nil {
+			_, err = queryError(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		rows := make(map[int]float64)
+		for _, row := range counts {
+			var id int
+			var n int64
+			if err := dbconnect.Scan(row, &id, &n); err != nil {
+				http.Error(w, dbError(err).Error(), http.StatusInternalServerError)
+				return
+			}
+			rows[id] = float64(n)
+		}
+		pending := make(map[int]float64)
+		for _, d := range r.Progress.Dirs() {
+			pending[d.DirId] = float64(d.PendingEvents)
+		}
+
+		var rowSamples, stateSamples, pendingSamples []metrics.Sample
+		for _, d := range dirs {
+			id := strconv.Itoa(d.Id)
+			rowSamples = append(rowSamples, metrics.Sample{Labels: []string{id, d.Path}, Value: rows[d.Id]})
+			pendingSamples = append(pendingSamples, metrics.Sample{Labels: []string{id, d.Path}, Value: pending[d.Id]})
+			for _, state := range dirStates {
+				value := 0.0
+				if d.State == state {
+					value = 1
+				}
+				stateSamples = append(stateSamples, metrics.Sample{Labels: []string{id, d.Path, state}, Value: value})
+			}
+		}
+		metrics.WriteGauge(w, "ariadne_files_rows", "Rows of the files table per watched dir.", []string{"dir_id", "path"}, rowSamples)
+		metrics.WriteGauge(w, "ariadne_watched_dir_state", "The state of the watched dirs, 1 for the current one.", []string{"dir_id", "path", "state"}, stateSamples)
+		metrics.WriteGauge(w, "ariadne_events_pending", "File system events waiting to be applied per watched dir.", []string{"dir_id", "path"}, pendingSamples)
+		metrics.WriteAll(w)
+	})
+}
@@ -0,0 +1,45 @@
+package jsonrpc
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/dbconnect"
+)
+
+func TestRowsPerDir(t *testing.T) {
+	// the rows indexed before the counts are counted by the migration
+	migrations := dbconnect.FilesMigrations
+	db := newFilesDb(t, migrations[:len(migrations)-1])
+	insertFiles(t, db, "a", "b")
+	if err := db.Migrate(migrations); err != nil {
+		t.Fatal(err)
+	}
+
+	rowsPerDirAre := func(want string) {
+		t.Helper()
+		rows, err := db.Query(rowsPerDir + " ORDER BY dir_id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := fmt.Sprint(rows); s != want {
+			t.Errorf("the rows per dir are %s, want %s", s, want)
+		}
+	}
+	rowsPerDirAre("[[1 2]]")
+
+	insertFiles(t, db, "c")
+	mustExec(t, db, "INSERT INTO files (dir_id, path_to_file, fname, size, mtime_ns, is_dir) VALUES (2, '/e/', 'c', 1, 1, 0)")
+	rowsPerDirAre("[[1 3] [2 1]]")
+
+	// an update of the row of an indexed file
+	mustExec(t, db, "INSERT INTO files (dir_id, path_to_file, fname, size, mtime_ns, is_dir) VALUES (1, '/d/', 'a', 2, 2, 0) "+
+		"ON CONFLICT(path_to_file, fname) DO UPDATE SET size = excluded.size")
+	rowsPerDirAre("[[1 3] [2 1]]")
+
+	mustExec(t, db, "UPDATE files SET dir_id = 2 WHERE fname = 'b'")
+	rowsPerDirAre("[[1 2] [2 2]]")
+
+	mustExec(t, db, "DELETE FROM files WHERE dir_id = 1")
+	rowsPerDirAre("[[2 2]]")
+}
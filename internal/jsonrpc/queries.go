@@ -0,0 +1,118 @@
+package jsonrpc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/auth"
+	"github.com/ariadne-tools/ariadne-daemon/internal/search"
+)
+
+// DefaultQueryTimeout is how long a query may run by default, so that it
+// can't hold the lock of a db for long.
+const DefaultQueryTimeout = 10 * time.Second
+
+// Queries gives the queries their deadline, and keeps the running searches
+// with an id, so that their clients can cancel them. The ids are in the
+// namespace of the token of the client, see scopeSearchId. A nil *Queries
+// gives them no deadline.
+type Queries struct {
+	timeout time.Duration
+
+	mu      sync.Mutex
+	running map[string]context.CancelFunc
+}
+
+// NewQueries makes the queries time out after timeout, or never if it's 0.
+func NewQueries(timeout time.Duration) *Queries {
+	return &Queries{timeout: timeout, running: make(map[string]context.CancelFunc)}
+}
+
+// start returns the context of a query, and the function to call when it's
+// done. An id, if given, can't be used by two running searches at once.
+func (q *Queries) start(id string) (context.Context, func(), error) {
+	if q == nil {
+		return context.Background(), func() {}, nil
+	}
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if q.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, q.timeout)
+	}
+	ctx, cancelByClient := context.WithCancel(ctx)
+	if id == "" {
+		return ctx, func() { cancelByClient(); cancel() }, nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, in := q.running[id]; in {
+		cancelByClient()
+		cancel()
+		return nil, nil, callErrorf(InvalidArgument, "a search with the id %q is running already", unscopedId(id))
+	}
+	q.running[id] = cancelByClient
+	return ctx, func() {
+		q.mu.Lock()
+		delete(q.running, id)
+		q.mu.Unlock()
+		cancelByClient()
+		cancel()
+	}, nil
+}
+
+// cancel cancels the running search with the id, and reports whether there was one.
+func (q *Queries) cancel(id string) bool {
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	cancel, in := q.running[id]
+	q.mu.Unlock()
+	if in {
+		cancel()
+	}
+	return in
+}
+
+// scopeSearchId puts the id of the search of a call into the namespace of the
+// token, so that only its clients can cancel the search, and the clients of
+// the other tokens can use the same ids. The codecs call it with the argument
+// of every method before the server does.
+func scopeSearchId(token auth.Token, serviceMethod string, args interface{}) {
+	scope := func(id *string) {
+		if *id != "" {
+			*id = token.Id + "/" + *id
+		}
+	}
+	switch args := args.(type) {
+	case *search.Request:
+		scope(&args.Id)
+	case *QueryRequest:
+		scope(&args.Id)
+	case *string:
+		if strings.TrimPrefix(serviceMethod, "RemoteCall.") == "Cancel" {
+			scope(args)
+		}
+	}
+}
+
+// unscopedId is the id of a search as its client gave it.
+func unscopedId(id string) string {
+	return id[strings.Index(id, "/")+1:]
+}
+
+// queryError is the error of a query that failed: Canceled if its client
+// canceled it, or if it timed out, then timedOut is true.
+func queryError(err error) (timedOut bool, callErr error) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return true, callErrorf(Canceled, "the query timed out")
+	case errors.Is(err, context.Canceled):
+		return false, callErrorf(Canceled, "the search was canceled")
+	default:
+		return false, dbError(err)
+	}
+}
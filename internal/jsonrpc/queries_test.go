@@ -0,0 +1,160 @@
+package jsonrpc
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/auth"
+	"github.com/ariadne-tools/ariadne-daemon/internal/dbconnect"
+	"github.com/ariadne-tools/ariadne-daemon/internal/search"
+)
+
+// scoped is the id of the search as the codecs of token pass it to the methods.
+func scoped(token auth.Token, id string) string {
+	req := search.Request{Id: id}
+	scopeSearchId(token, "RemoteCall.Find", &req)
+	return req.Id
+}
+
+func TestSearchIdsPerToken(t *testing.T) {
+	q := NewQueries(0)
+	alice := auth.Token{Scopes: []auth.Scope{auth.SearchScope}, Id: "alice"}
+	bob := auth.Token{Scopes: []auth.Scope{auth.SearchScope}, Id: "bob"}
+
+	ctx, done, err := q.start(scoped(alice, "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+	if _, _, err := q.start(scoped(alice, "1")); ErrorKind(err) != InvalidArgument {
+		t.Errorf("two searches of a token with the same id: %v", err)
+	} else if err.Error() != `invalid argument: a search with the id "1" is running already` {
+		t.Errorf("the error tells the scoped id: %v", err)
+	}
+	_, bobDone, err := q.start(scoped(bob, "1"))
+	if err != nil {
+		t.Fatalf("the id of a search of an other token is taken: %v", err)
+	}
+	bobDone()
+
+	id := "1"
+	scopeSearchId(bob, "RemoteCall.Cancel", &id)
+	if q.cancel(id) || ctx.Err() != nil {
+		t.Errorf("an other token canceled the search")
+	}
+	id = "1"
+	scopeSearchId(alice, "Cancel", &id)
+	if !q.cancel(id) || ctx.Err() == nil {
+		t.Errorf("the token couldn't cancel its search")
+	}
+
+	// the strings of the other methods aren't ids
+	path := "/home"
+	scopeSearchId(alice, "RemoteCall.Remove", &path)
+	if path != "/home" {
+		t.Errorf("the argument of Remove was scoped to %q", path)
+	}
+}
+
+func TestQueriesTimeOut(t *testing.T) {
+	db := newFilesDb(t, dbconnect.FilesMigrations)
+	watched := newFilesDb(t, dbconnect.WatchedMigrations)
+	r := RemoteCall{Filesdb: db, Watcheddb: watched, Queries: NewQueries(time.Nanosecond)}
+	time.Sleep(time.Millisecond)
+
+	var changes ChangesReply
+	if err := r.Changes(ChangesRequest{}, &changes); ErrorKind(err) != Canceled {
+		t.Errorf("Changes didn't time out: %v", err)
+	}
+	var dirs []WatchedDirsState
+	if err := r.WatchedDirs(struct{}{}, &dirs); ErrorKind(err) != Canceled {
+		t.Errorf("WatchedDirs didn't time out: %v", err)
+	}
+
+	r.Queries = NewQueries(0)
+	if err := r.Changes(ChangesRequest{}, &changes); err != nil {
+		t.Errorf("Changes failed without a timeout: %v", err)
+	}
+}
+
+func TestMetricsTimeOut(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := ioutil.WriteFile(path, []byte("secret search\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := auth.LoadOrCreate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := RemoteCall{
+		Filesdb:   newFilesDb(t, dbconnect.FilesMigrations),
+		Watcheddb: newFilesDb(t, dbconnect.WatchedMigrations),
+		Tokens:    tokens,
+		Queries:   NewQueries(time.Nanosecond),
+	}
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", auth.Header("secret"))
+	w := httptest.NewRecorder()
+	NewMetricsHandler(r).ServeHTTP(w, req)
+	if w.Code != 500 || w.Body.String() != "canceled: the query timed out\n" {
+		t.Errorf("the metrics got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestCancelFind(t *testing.T) {
+	db := newFilesDb(t, dbconnect.FilesMigrations)
+	insertFiles(t, db, "a.txt")
+	r := RemoteCall{Filesdb: db, Queries: NewQueries(0)}
+
+	// the search waits for the lock of the db, as it would behind a slow query
+	db.Lock()
+	defer db.Unlock()
+	found := make(chan error)
+	go func() {
+		var reply SearchReply
+		found <- r.Find(search.Request{Pattern: "a", Id: "1"}, &reply)
+	}()
+
+	var canceled bool
+	for !canceled {
+		if err := r.Cancel("1", &canceled); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case err := <-found:
+		if ErrorKind(err) != Canceled {
+			t.Errorf("the canceled search returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the canceled search is still running")
+	}
+}
+
+func TestFindRankedTruncated(t *testing.T) {
+	db := newFilesDb(t, dbconnect.FilesMigrations)
+	for _, name := range []string{"ab", "xab", "a_b", "c"} {
+		mustExec(t, db, "INSERT INTO files (dir_id, path_to_file, fname, path_key, fname_key, size, mtime_ns, is_dir) VALUES (1, '/d/', ?, '/d/', ?, 1, 1, 0)", name, name)
+	}
+	r := RemoteCall{Filesdb: db, Queries: NewQueries(0)}
+
+	for _, test := range []struct {
+		limit     int
+		truncated bool
+	}{{2, true}, {3, false}, {4, false}} {
+		var reply SearchReply
+		if err := r.Find(search.Request{Pattern: "ab", Mode: search.Ranked, Limit: test.limit}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Truncated != test.truncated {
+			t.Errorf("limit %d: truncated %v with %d files", test.limit, reply.Truncated, len(reply.Files))
+		}
+		if len(reply.Files) == 0 || reply.Files[0].Fname != "ab" {
+			t.Errorf("limit %d: the exact match isn't the first: %+v", test.limit, reply.Files)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/access"
+	"github.com/ariadne-tools/ariadne-daemon/internal/auth"
+)
+
+// The error codes of the JSON-RPC 2.0 specification.
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+	CodeServerError    = -32000 // the method returned an error
+	CodeUnauthorized   = -32001 // missing or invalid token
+	CodeForbidden      = -32003 // the token doesn't grant the method
+)
+
+// MaxRequestSize is the largest body a JSON-RPC request can have.
+const MaxRequestSize = 1 << 20
+
+type request struct {
+	Version string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	Id      json.RawMessage `json:"id"` // empty for notifications
+}
+
+type response struct {
+	Version string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+	Id      json.RawMessage `json:"id"`
+}
+
+// Error is the error object of a JSON-RPC 2.0 response.
+type Error struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+var null = json.RawMessage("null")
+
+// serverCodec feeds a single request to an rpc.Server, and keeps its response.
+type serverCodec struct {
+	req       request
+	token     auth.Token
+	filter    func(reply interface{}) // see RemoteCall.replyFilter
+	read      bool
+	paramsErr error
+	resp      response
+}
+
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	if c.read {
+		return io.EOF
+	}
+	c.read = true
+
+	r.ServiceMethod = c.req.Method
+	if !strings.Contains(r.ServiceMethod, ".") {
+		r.ServiceMethod = "RemoteCall." + r.ServiceMethod
+	}
+	r.Seq = 0
+	return nil
+}
+
+// ReadRequestBody decodes the params into the argument of the method. The
+// array params of the methods taking a slice are the slice itself, e.g.
+// ["/dir"] for Add. For the other methods they hold the single argument.
+func (c *serverCodec) ReadRequestBody(x interface{}) error {
+	if x == nil {
+		return nil
+	}
+	params := bytes.TrimSpace(c.req.Params)
+	if len(params) == 0 || bytes.Equal(params, null) {
+		return nil
+	}
+	if params[0] == '[' && !takesSlice(x) {
+		var array []json.RawMessage
+		if err := json.Unmarshal(params, &array); err != nil {
+			c.paramsErr = err
+			return err
+		}
+		switch len(array) {
+		case 0:
+			return nil
+		case 1:
+			params = array[0]
+		default:
+			c.paramsErr = errors.New("the methods take a single parameter")
+			return c.paramsErr
+		}
+	}
+	if err := json.Unmarshal(params, x); err != nil {
+		c.paramsErr = err
+		return err
+	}
+	scopeSearchId(c.token, c.req.Method, x)
+	return nil
+}
+
+// takesSlice tells whether the argument x points to is a slice or an array.
+func takesSlice(x interface{}) bool {
+	t := reflect.TypeOf(x)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Slice || t.Kind() == reflect.Array
+}
+
+func (c *serverCodec) WriteResponse(r *rpc.Response, x interface{}) error {
+	c.resp = response{Version: "2.0", Id: c.req.Id}
+	switch {
+	case r.Error == "":
+		if c.filter != nil {
+			c.filter(x)
+		}
+		c.resp.Result = x
+	case c.paramsErr != nil:
+		c.resp.Error = &Error{Code: CodeInvalidParams, Message: "invalid params: " + c.paramsErr.Error()}
+	case strings.HasPrefix(r.Error, "rpc: can't find"):
+		c.resp.Error = &Error{Code: CodeMethodNotFound, Message: "method not found: " + c.req.Method}
+	default:
+		c.resp.Error = &Error{Code: errorCode(r.Error), Message: r.Error}
+		if kind := ErrorKind(errors.New(r.Error)); kind != "" {
+			c.resp.Error.Data = map[string]Kind{"kind": kind}
+		}
+	}
+	return nil
+}
+
+func (c *serverCodec) Close() error {
+	return nil
+}
+
+// NewHTTPHandler serves the methods of server, where r is registered, as
+// JSON-RPC 2.0 over HTTP POST, batches included. The "RemoteCall." prefix of
+// the method names is optional. The requests need an "Authorization: Bearer
+// <token>" header, and only the methods the token grants are called. The
+// callers on Unix sockets only get the files they could list.
+func NewHTTPHandler(server *rpc.Server, r RemoteCall) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "JSON-RPC requests have to be POSTed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		token, ok := r.Tokens.FromRequest(req)
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(errorResponse(nil, CodeUnauthorized, "missing or invalid token"))
+			return
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, MaxRequestSize+1))
+		if err != nil {
+			return
+		}
+
+		var reply interface{}
+		if len(body) > MaxRequestSize {
+			reply = errorResponse(nil, CodeInvalidRequest, "request too large")
+		} else {
+			reply = serveBody(server, token, r.replyFilter(access.FromRequest(req)), body)
+		}
+		if reply == nil {
+			// only notifications
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reply)
+	})
+}
+
+// serveBody serves a single request or a batch, and returns what to reply, or
+// nil if there's nothing to reply.
+func serveBody(server *rpc.Server, token auth.Token, filter func(interface{}), body []byte) interface{} {
+	body = bytes.TrimSpace(body)
+	if !json.Valid(body) {
+		return errorResponse(nil, CodeParseError, "parse error")
+	}
+
+	if len(body) == 0 || body[0] != '[' {
+		if resp := serveOne(server, token, filter, body); resp != nil {
+			return resp
+		}
+		return nil
+	}
+
+	var batch []json.RawMessage
+	json.Unmarshal(body, &batch)
+	if len(batch) == 0 {
+		return errorResponse(nil, CodeInvalidRequest, "empty batch")
+	}
+	var responses []*response
+	for _, raw := range batch {
+		if resp := serveOne(server, token, filter, raw); resp != nil {
+			responses = append(responses, resp)
+		}
+	}
+	if len(responses) == 0 {
+		return nil
+	}
+	return responses
+}
+
+// serveOne serves a request, and returns its response, or nil for a notification.
+func serveOne(server *rpc.Server, token auth.Token, filter func(interface{}), raw json.RawMessage) *response {
+	var req request
+	if err := json.Unmarshal(raw, &req); err != nil || req.Version != "2.0" || req.Method == "" {
+		if err != nil {
+			req.Id = nil
+		}
+		return errorResponse(req.Id, CodeInvalidRequest, "invalid request")
+	}
+
+	start := time.Now()
+	if err := authorize(token, req.Method); err != nil {
+		observeCall(req.Method, "forbidden", start)
+		if len(req.Id) == 0 {
+			return nil
+		}
+		return errorResponse(req.Id, CodeForbidden, err.Error())
+	}
+
+	codec := &serverCodec{req: req, token: token, filter: filter}
+	if err := server.ServeRequest(codec); err != nil && codec.resp.Version == "" {
+		// the request wasn't even dispatched, so nothing was written
+		codec.WriteResponse(&rpc.Response{Error: err.Error()}, nil)
+	}
+	status := "ok"
+	if codec.resp.Error != nil {
+		status = "error"
+	}
+	observeCall(req.Method, status, start)
+	if len(req.Id) == 0 {
+		return nil
+	}
+	return &codec.resp
+}
+
+func errorResponse(id json.RawMessage, code int, message string) *response {
+	if len(id) == 0 {
+		id = null
+	}
+	return &response{Version: "2.0", Error: &Error{Code: code, Message: message}, Id: id}
+}
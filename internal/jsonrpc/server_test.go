@@ -0,0 +1,217 @@
+package jsonrpc
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/rpc"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/auth"
+)
+
+// echo stands in for RemoteCall, with methods of every kind of argument.
+type echo struct{}
+
+type EchoArgs struct {
+	Pattern string
+	Limit   int
+}
+
+func (echo) Add(paths []string, added *[]string) error {
+	*added = paths
+	return nil
+}
+
+func (echo) Find(args EchoArgs, reply *EchoArgs) error {
+	*reply = args
+	return nil
+}
+
+// Cancel cancels the search 1 of adminToken, its id being in the namespace of
+// the token, see scopeSearchId.
+func (echo) Cancel(id string, canceled *bool) error {
+	*canceled = id == adminToken.Id+"/1"
+	return nil
+}
+
+func (echo) SavedSearchHits(id int, reply *int) error {
+	return callErrorf(NotFound, "no saved search with the id %d", id)
+}
+
+func newEchoServer(t *testing.T) *rpc.Server {
+	t.Helper()
+	server := rpc.NewServer()
+	if err := server.RegisterName("RemoteCall", echo{}); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+var adminToken = auth.Token{Scopes: []auth.Scope{auth.AdminScope}, Id: "admin"}
+
+// serve serves body and returns the reply as JSON.
+func serve(t *testing.T, server *rpc.Server, token auth.Token, body string) string {
+	t.Helper()
+	reply := serveBody(server, token, nil, []byte(body))
+	if reply == nil {
+		return ""
+	}
+	b, err := json.Marshal(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestServeParams(t *testing.T) {
+	server := newEchoServer(t)
+	tests := []struct {
+		body, want string
+	}{
+		// the params array of a method taking a slice is the slice
+		{`{"jsonrpc":"2.0","method":"Add","params":["/a"],"id":1}`,
+			`{"jsonrpc":"2.0","result":["/a"],"id":1}`},
+		{`{"jsonrpc":"2.0","method":"Add","params":["/a","/b"],"id":1}`,
+			`{"jsonrpc":"2.0","result":["/a","/b"],"id":1}`},
+		{`{"jsonrpc":"2.0","method":"RemoteCall.Find","params":{"Pattern":"x","Limit":2},"id":"a"}`,
+			`{"jsonrpc":"2.0","result":{"Pattern":"x","Limit":2},"id":"a"}`},
+		{`{"jsonrpc":"2.0","method":"Find","params":[{"Pattern":"x"}],"id":2}`,
+			`{"jsonrpc":"2.0","result":{"Pattern":"x","Limit":0},"id":2}`},
+		{`{"jsonrpc":"2.0","method":"Find","id":3}`,
+			`{"jsonrpc":"2.0","result":{"Pattern":"","Limit":0},"id":3}`},
+		{`{"jsonrpc":"2.0","method":"Cancel","params":["1"],"id":4}`,
+			`{"jsonrpc":"2.0","result":true,"id":4}`},
+		{`{"jsonrpc":"2.0","method":"Find","params":[{},{}],"id":5}`,
+			`{"jsonrpc":"2.0","error":{"code":-32602,"message":"invalid params: the methods take a single parameter"},"id":5}`},
+		{`{"jsonrpc":"2.0","method":"Add","params":{"Pattern":"x"},"id":6}`,
+			`{"jsonrpc":"2.0","error":{"code":-32602,"message":"invalid params: json: cannot unmarshal object into Go value of type []string"},"id":6}`},
+	}
+	for _, test := range tests {
+		if got := serve(t, server, adminToken, test.body); got != test.want {
+			t.Errorf("%s\n got %s\nwant %s", test.body, got, test.want)
+		}
+	}
+}
+
+func TestServeErrors(t *testing.T) {
+	server := newEchoServer(t)
+	searchToken := auth.Token{Scopes: []auth.Scope{auth.SearchScope}}
+	tests := []struct {
+		token      auth.Token
+		body, want string
+	}{
+		{adminToken, `{"jsonrpc":"2.0","method":"Find",`,
+			`{"jsonrpc":"2.0","error":{"code":-32700,"message":"parse error"},"id":null}`},
+		{adminToken, `{"method":"Find","id":1}`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"invalid request"},"id":1}`},
+		{adminToken, `{"jsonrpc":"2.0","method":"Nope","id":1}`,
+			`{"jsonrpc":"2.0","error":{"code":-32601,"message":"method not found: Nope"},"id":1}`},
+		{searchToken, `{"jsonrpc":"2.0","method":"Add","params":["/a"],"id":1}`,
+			`{"jsonrpc":"2.0","error":{"code":-32003,"message":"auth: Add needs a token with the manage scope"},"id":1}`},
+		{adminToken, `{"jsonrpc":"2.0","method":"SavedSearchHits","params":[7],"id":1}`,
+			`{"jsonrpc":"2.0","error":{"code":-32004,"message":"not found: no saved search with the id 7","data":{"kind":"not found"}},"id":1}`},
+		{adminToken, `[]`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"empty batch"},"id":null}`},
+	}
+	for _, test := range tests {
+		if got := serve(t, server, test.token, test.body); got != test.want {
+			t.Errorf("%s\n got %s\nwant %s", test.body, got, test.want)
+		}
+	}
+}
+
+func TestServeBatch(t *testing.T) {
+	server := newEchoServer(t)
+	body := `[
+		{"jsonrpc":"2.0","method":"Cancel","params":["1"],"id":1},
+		{"jsonrpc":"2.0","method":"Cancel","params":["2"]},
+		{"jsonrpc":"2.0","method":"Add","params":["/a"],"id":2}
+	]`
+	want := `[{"jsonrpc":"2.0","result":true,"id":1},{"jsonrpc":"2.0","result":["/a"],"id":2}]`
+	if got := serve(t, server, adminToken, body); got != want {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+
+	notifications := `[{"jsonrpc":"2.0","method":"Cancel","params":["1"]}]`
+	if got := serve(t, server, adminToken, notifications); got != "" {
+		t.Errorf("a batch of notifications got %s, want no reply", got)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	tokens := map[auth.Scope]auth.Token{}
+	for _, scope := range []auth.Scope{auth.SearchScope, auth.ManageScope, auth.AdminScope} {
+		tokens[scope] = auth.Token{Scopes: []auth.Scope{scope}}
+	}
+
+	methods := reflect.TypeOf(RemoteCall{})
+	for i := 0; i < methods.NumMethod(); i++ {
+		method := methods.Method(i).Name
+		needed, in := MethodScopes[method]
+		if !in {
+			needed = auth.AdminScope
+		}
+		for scope, token := range tokens {
+			want := scope == needed || scope == auth.AdminScope
+			for _, name := range []string{method, "RemoteCall." + method} {
+				if err := authorize(token, name); (err == nil) != want {
+					t.Errorf("a token of the %s scope calling %s: %v", scope, name, err)
+				}
+			}
+		}
+		if authorize(auth.Token{}, method) == nil {
+			t.Errorf("a token without scopes can call %s", method)
+		}
+	}
+
+	for method := range MethodScopes {
+		if _, in := methods.MethodByName(method); !in {
+			t.Errorf("RemoteCall has no method %s for its scope", method)
+		}
+	}
+	// the methods without a scope, and the ones RemoteCall doesn't have, need the admin scope
+	for _, method := range []string{"Shutdown", "Reload", "Nope"} {
+		if authorize(tokens[auth.ManageScope], method) == nil || authorize(tokens[auth.AdminScope], method) != nil {
+			t.Errorf("%s doesn't need the admin scope", method)
+		}
+	}
+}
+
+func TestHTTPHandlerTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := ioutil.WriteFile(path, []byte("searcher search\nmanager manage\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := auth.LoadOrCreate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHTTPHandler(newEchoServer(t), RemoteCall{Tokens: tokens, Queries: NewQueries(0)})
+
+	tests := []struct {
+		header, method string
+		want           string
+	}{
+		{"", "Find", `{"jsonrpc":"2.0","error":{"code":-32001,"message":"missing or invalid token"},"id":null}`},
+		{auth.Header("wrong"), "Find", `{"jsonrpc":"2.0","error":{"code":-32001,"message":"missing or invalid token"},"id":null}`},
+		{auth.Header("searcher"), "Find", `{"jsonrpc":"2.0","result":{"Pattern":"","Limit":0},"id":1}`},
+		{auth.Header("searcher"), "Add", `{"jsonrpc":"2.0","error":{"code":-32003,"message":"auth: Add needs a token with the manage scope"},"id":1}`},
+		{auth.Header("manager"), "Add", `{"jsonrpc":"2.0","result":null,"id":1}`},
+		{auth.Header("manager"), "Find", `{"jsonrpc":"2.0","error":{"code":-32003,"message":"auth: Find needs a token with the search scope"},"id":1}`},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/rpc", strings.NewReader(`{"jsonrpc":"2.0","method":"`+test.method+`","id":1}`))
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if got := strings.TrimSpace(w.Body.String()); got != test.want {
+			t.Errorf("%s with %q\n got %s\nwant %s", test.method, test.header, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package listener
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Listen opens the listener described by addr, which is either
+//
+//	unix:/path/to/socket   a Unix domain socket only its owner can connect to
+//	tcp:host:port          a TCP socket, or just host:port (:port for every interface)
+//
+// The mode and the group of a Unix socket can be given after its path, e.g.
+// unix:/run/ariadne.sock?mode=0660&group=ariadne lets the members of the
+// group connect too. If tlsConfig isn't nil, the TCP connections are served
+// over TLS with it.
+func Listen(addr string, tlsConfig *tls.Config) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		path, opts, err := ParseUnix(strings.TrimPrefix(addr, "unix:"))
+		if err != nil {
+			return nil, err
+		}
+		return listenUnix(path, opts)
+	}
+	if !strings.Contains(addr, ":") {
+		return nil, fmt.Errorf("listen: unknown address %q, use unix:/path or tcp:host:port", addr)
+	}
+
+	ln, err := net.Listen("tcp", strings.TrimPrefix(addr, "tcp:"))
+	if err != nil || tlsConfig == nil {
+		return ln, err
+	}
+	return tls.NewListener(ln, tlsConfig), nil
+}
+
+// TLSConfig loads the certificate and the key of the server. If clientCAFile
+// isn't empty, the clients have to present a certificate signed by one of the
+// CAs in it.
+func TLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("listen: %v", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("listen: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("listen: no certificates found in %s", clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// UnixOptions are the mode and the group of a Unix socket.
+type UnixOptions struct {
+	Mode  os.FileMode
+	Group string // a name or a gid, or "" to keep the group of the daemon
+}
+
+// ParseUnix splits the path of a Unix socket and the options after it, see Listen.
+func ParseUnix(s string) (string, UnixOptions, error) {
+	opts := UnixOptions{Mode: 0600}
+	i := strings.Index(s, "?")
+	if i < 0 {
+		return s, opts, nil
+	}
+	query, err := url.ParseQuery(s[i+1:])
+	if err != nil {
+		return "", opts, fmt.Errorf("listen: invalid options of the unix socket %q: %v", s, err)
+	}
+	for key, values := range query {
+		value := values[len(values)-1]
+		switch key {
+		case "mode":
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || mode&^0777 != 0 {
+				return "", opts, fmt.Errorf("listen: invalid mode %q of the unix socket, e.g. 0660", value)
+			}
+			opts.Mode = os.FileMode(mode)
+		case "group":
+			opts.Group = value
+		default:
+			return "", opts, fmt.Errorf("listen: unknown option %q of the unix socket, use mode or group", key)
+		}
+	}
+	return s[:i], opts, nil
+}
+
+// listenUnix creates the socket in a directory only the daemon can enter, and
+// moves it to path once its mode and group are set, so no one can connect to
+// it before that.
+func listenUnix(path string, opts UnixOptions) (net.Listener, error) {
+	if path == "" {
+		return nil, fmt.Errorf("listen: missing path of the unix socket")
+	}
+	gid := -1
+	if opts.Group != "" {
+		g, err := user.LookupGroup(opts.Group)
+		if err != nil {
+			if g, err = user.LookupGroupId(opts.Group); err != nil {
+				return nil, fmt.Errorf("listen: unknown group %q of the unix socket", opts.Group)
+			}
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return nil, fmt.Errorf("listen: the group %q has the gid %q", opts.Group, g.Gid)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := removeStale(path); err != nil {
+		return nil, err
+	}
+
+	private, err := ioutil.TempDir(filepath.Dir(path), ".listen")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(private)
+	tmp := filepath.Join(private, "socket")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// the socket is removed by its new path
+	ln.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, opts.Mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if gid >= 0 {
+		if err := os.Lchown(tmp, -1, gid); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &unixListener{ln, path}, nil
+}
+
+// unixListener removes its socket when it's closed, like net.UnixListener does
+// with the path it was created at.
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// removeStale removes the socket left behind by a daemon that didn't exit
+// cleanly. It refuses to touch anything else, or a socket that's still served.
+func removeStale(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("listen: %s exists and it's not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("listen: %s is in use, is an other daemon running?", path)
+	}
+	return os.Remove(path)
+}
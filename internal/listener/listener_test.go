@@ -0,0 +1,212 @@
+package listener
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate with its key, signed by parent or by itself.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert, isCA bool, usage x509.ExtKeyUsage) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert, key, der}
+}
+
+// files writes the certificate and its key as PEM, and returns their paths.
+func (c *testCert) files(t *testing.T) (string, string) {
+	t.Helper()
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(certFile, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// serveTLS listens on a loopback port with the config, and greets every
+// client that gets through the handshake.
+func serveTLS(t *testing.T, config *tls.Config) string {
+	t.Helper()
+	ln, err := Listen("tcp:127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if err := conn.(*tls.Conn).Handshake(); err == nil {
+					conn.Write([]byte("hi"))
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// greet connects to addr, and tells whether the server greeted the client.
+func greet(addr string, roots *x509.CertPool, certs []tls.Certificate) error {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, Certificates: certs})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// with TLS 1.3 the server checks the certificate of the client after the
+	// handshake of the client, so it's refused only at the first read
+	buf := make([]byte, 2)
+	_, err = conn.Read(buf)
+	return err
+}
+
+func TestTLS(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, true, 0)
+	otherCA := newTestCert(t, "other ca", nil, true, 0)
+	server := newTestCert(t, "server", ca, false, x509.ExtKeyUsageServerAuth)
+	client := newTestCert(t, "client", ca, false, x509.ExtKeyUsageClientAuth)
+	stranger := newTestCert(t, "stranger", otherCA, false, x509.ExtKeyUsageClientAuth)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	certFile, keyFile := server.files(t)
+	caFile, _ := ca.files(t)
+
+	t.Run("without client CA", func(t *testing.T) {
+		config, err := TLSConfig(certFile, keyFile, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := serveTLS(t, config)
+		if err := greet(addr, roots, nil); err != nil {
+			t.Errorf("a client without a certificate was refused: %v", err)
+		}
+		if err := greet(addr, x509.NewCertPool(), nil); err == nil {
+			t.Errorf("the client trusted a server signed by an unknown CA")
+		}
+	})
+
+	t.Run("with client CA", func(t *testing.T) {
+		config, err := TLSConfig(certFile, keyFile, caFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := serveTLS(t, config)
+		if err := greet(addr, roots, []tls.Certificate{client.tlsCert()}); err != nil {
+			t.Errorf("a client with a certificate of the CA was refused: %v", err)
+		}
+		if err := greet(addr, roots, nil); err == nil {
+			t.Errorf("a client without a certificate got through")
+		}
+		if err := greet(addr, roots, []tls.Certificate{stranger.tlsCert()}); err == nil {
+			t.Errorf("a client with a certificate of an other CA got through")
+		}
+	})
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, true, 0)
+	server := newTestCert(t, "server", ca, false, x509.ExtKeyUsageServerAuth)
+	certFile, keyFile := server.files(t)
+	notPem := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(notPem, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := TLSConfig(certFile, certFile, ""); err == nil {
+		t.Errorf("loaded a certificate as its own key")
+	}
+	if _, err := TLSConfig(certFile, keyFile, notPem); err == nil {
+		t.Errorf("loaded client CAs from a file without certificates")
+	}
+	if _, err := TLSConfig(certFile, keyFile, filepath.Join(t.TempDir(), "missing.pem")); err == nil {
+		t.Errorf("loaded client CAs from a missing file")
+	}
+}
+
+func TestParseUnix(t *testing.T) {
+	path, opts, err := ParseUnix("/run/a.sock")
+	if err != nil || path != "/run/a.sock" || opts != (UnixOptions{Mode: 0600}) {
+		t.Errorf("got %q, %+v, %v without options", path, opts, err)
+	}
+	path, opts, err = ParseUnix("/run/a.sock?mode=0660&group=ariadne")
+	if err != nil || path != "/run/a.sock" || opts != (UnixOptions{Mode: 0660, Group: "ariadne"}) {
+		t.Errorf("got %q, %+v, %v", path, opts, err)
+	}
+	for _, bad := range []string{"/a?mode=660x", "/a?mode=01777", "/a?owner=me", "/a?mode=%"} {
+		if _, _, err := ParseUnix(bad); err == nil {
+			t.Errorf("%s was parsed", bad)
+		}
+	}
+	if _, err := Listen("unix:"+filepath.Join(t.TempDir(), "a.sock")+"?group=no-such-group-here", nil); err == nil {
+		t.Errorf("listened with an unknown group")
+	}
+}
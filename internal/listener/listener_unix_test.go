@@ -0,0 +1,47 @@
+//go:build !windows
+// +build !windows
+
+package listener
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestUnixSocketMode(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ariadne.sock")
+	gid := os.Getgid()
+	ln, err := Listen(fmt.Sprintf("unix:%s?mode=0660&group=%d", path, gid), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ln.Addr().String() != path {
+		t.Errorf("the socket listens at %s, want %s", ln.Addr(), path)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0660 {
+		t.Errorf("the socket has the mode %v, want 0660", info.Mode())
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Gid) != gid {
+		t.Errorf("the socket has the group %d, want %d", st.Gid, gid)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("can't connect to the moved socket: %v", err)
+	}
+	conn.Close()
+
+	ln.Close()
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("%d files are left after closing the socket, e.g. %s", len(entries), entries[0].Name())
+	}
+}
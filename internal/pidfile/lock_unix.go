@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+package pidfile
+
+import (
+	"os"
+	"syscall"
+)
+
+// openLocked opens the file at path, creating it if needed, and locks it. The
+// lock is released when the file is closed, or the process exits.
+func openLocked(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errLocked
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// release removes the file before unlocking it, so no other process locks it
+// in between, see Lock.
+func release(f *os.File, path string) error {
+	err := os.Remove(path)
+	f.Close()
+	return err
+}
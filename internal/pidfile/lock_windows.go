@@ -0,0 +1,34 @@
+package pidfile
+
+import (
+	"os"
+	"syscall"
+)
+
+// errorSharingViolation is ERROR_SHARING_VIOLATION, the file is opened by an
+// other process that doesn't share it.
+const errorSharingViolation syscall.Errno = 32
+
+// openLocked opens the file at path, creating it if needed, without sharing
+// it for writing or deleting until it's closed, or the process exits.
+func openLocked(path string) (*os.File, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	h, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, syscall.FILE_SHARE_READ, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err == errorSharingViolation {
+		return nil, errLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(h), path), nil
+}
+
+// release closes the file before removing it, it can't be removed while it's
+// open. An other process opening it in between keeps it.
+func release(f *os.File, path string) error {
+	f.Close()
+	return os.Remove(path)
+}
@@ -0,0 +1,71 @@
+// Package pidfile keeps the file with the process id of the running daemon,
+// so that a second daemon doesn't start on the same state.
+package pidfile
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// errLocked is returned by openLocked if an other process holds the file.
+var errLocked = errors.New("pidfile: locked")
+
+// File is a pidfile held by the process.
+type File struct {
+	f    *os.File
+	path string
+}
+
+// Lock writes the pid of the process to path, and holds a lock on the file
+// until Remove is called or the process exits. It fails if an other process
+// holds it. The file of a daemon that died isn't held by anyone, so it's
+// replaced, even if its pid was given to an other process since.
+func Lock(path string) (*File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	for {
+		f, err := openLocked(path)
+		if err == errLocked {
+			content, _ := ioutil.ReadFile(path)
+			return nil, fmt.Errorf("pidfile: the daemon is already running with pid %s, see %s", strings.TrimSpace(string(content)), path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// the daemon holding the file may have removed it after it was opened,
+		// then the lock is of a file no one else sees, open it again
+		locked, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if current, err := os.Stat(path); err != nil && !os.IsNotExist(err) {
+			f.Close()
+			return nil, err
+		} else if err != nil || !os.SameFile(locked, current) {
+			f.Close()
+			continue
+		}
+
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &File{f, path}, nil
+	}
+}
+
+// Remove removes the file, and releases its lock.
+func (p *File) Remove() error {
+	return release(p.f, p.path)
+}
@@ -0,0 +1,54 @@
+package pidfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run", "daemon.pid")
+	p, err := Lock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := strconv.Itoa(os.Getpid())
+	if string(content) != pid+"\n" {
+		t.Errorf("the pidfile has %q, want the pid %s", content, pid)
+	}
+
+	// the lock is of the open file, so the same process can't get it twice either
+	if _, err := Lock(path); err == nil || !strings.Contains(err.Error(), "running with pid "+pid) {
+		t.Errorf("a held pidfile was locked again: %v", err)
+	}
+
+	if err := p.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("the pidfile is left after Remove: %v", err)
+	}
+}
+
+func TestLockStale(t *testing.T) {
+	// the pidfile of a daemon that died, its pid may be of an other process by now
+	path := filepath.Join(t.TempDir(), "daemon.pid")
+	if err := ioutil.WriteFile(path, []byte("1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := Lock(path)
+	if err != nil {
+		t.Fatalf("the pidfile no one holds wasn't replaced: %v", err)
+	}
+	defer p.Remove()
+	if content, _ := ioutil.ReadFile(path); string(content) != strconv.Itoa(os.Getpid())+"\n" {
+		t.Errorf("the pidfile has %q", content)
+	}
+}
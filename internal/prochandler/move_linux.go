@@ -0,0 +1,16 @@
+package prochandler
+
+import (
+	"github.com/rjeczalik/notify"
+	"golang.org/x/sys/unix"
+)
+
+// moveCookie returns the cookie inotify pairs the two events of a move with:
+// the one of the old name (a notify.Rename) and the one of the new name (a
+// notify.Create).
+func moveCookie(event notify.EventInfo) (uint32, bool) {
+	if e, ok := event.Sys().(*unix.InotifyEvent); ok && e.Mask&(unix.IN_MOVED_FROM|unix.IN_MOVED_TO) != 0 && e.Cookie != 0 {
+		return e.Cookie, true
+	}
+	return 0, false
+}
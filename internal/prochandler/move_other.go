@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package prochandler
+
+import "github.com/rjeczalik/notify"
+
+// moveCookie is only implemented on Linux, elsewhere a move is a removal and a creation.
+func moveCookie(event notify.EventInfo) (uint32, bool) {
+	return 0, false
+}
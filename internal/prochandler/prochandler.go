@@ -1,26 +1,48 @@
 package prochandler
 
 import (
+	"fmt"
 	"io"
-	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/ariadne-tools/ariadne-daemon/internal/access"
 	"github.com/ariadne-tools/ariadne-daemon/internal/dbconnect"
+	"github.com/ariadne-tools/ariadne-daemon/internal/fsevents"
 	"github.com/ariadne-tools/ariadne-daemon/internal/logger"
+	"github.com/ariadne-tools/ariadne-daemon/internal/metrics"
+	"github.com/ariadne-tools/ariadne-daemon/internal/progress"
+	"github.com/ariadne-tools/ariadne-daemon/internal/textfold"
 	"github.com/rjeczalik/notify"
 )
 
 const UPDATE_BUFFER = 65536
 
+// retryAfter is how long a procHandler waits after a failure of the dbs
+const retryAfter = 5 * time.Second
+
+var (
+	eventsReceived = metrics.NewCounter("ariadne_events_received_total", "File system events received by the procHandlers.", "dir_id")
+	eventsApplied  = metrics.NewCounter("ariadne_events_applied_total", "File system events applied to the index by the procHandlers.", "dir_id")
+	eventsDropped  = metrics.NewCounter("ariadne_events_dropped_total", "Times the event buffer of a procHandler was full, so events were lost and the dir was reindexed.", "dir_id")
+)
+
 type ProcHandler struct {
 	DirId     int
 	Watcheddb *dbconnect.DbConnector
 	Filesdb   *dbconnect.DbConnector
 	DoneID    chan int
+	Events    *fsevents.Bus // the changes applied by update are published here
+	Progress  *progress.Tracker
+
+	// the change of one half of a move, until it turns out whether the other
+	// half follows, i.e. the file was renamed within the watched dir, see moveCookie
+	moveHalf   *fsevents.Change
+	moveCookie uint32
 }
 
 func (ph *ProcHandler) Handle() {
@@ -32,30 +54,54 @@ func (ph *ProcHandler) Handle() {
 	events := make([]notify.EventInfo, 0, UPDATE_BUFFER)
 	var m sync.Mutex
 
-	watchedDir := ph.getWatchedDir()
+	watchedDir, err := ph.getWatchedDir()
+	if err != nil {
+		// the generator starts another procHandler the next time it sees the dir
+		logger.InfoLog("WARNING: procHandler -> cannot start handling dir_id", ph.DirId, ":", err)
+		ph.DoneID <- ph.DirId
+		return
+	}
 	if err := notify.Watch(path.Join(watchedDir, "..."), c, notify.All); err != nil {
 		logger.InfoLog("WARNING: Handling file system events failed for the following dir: ", err)
+		ph.Progress.Error(ph.DirId)
 	} else {
 		defer notify.Stop(c)
 	}
+	dirLabel := strconv.Itoa(ph.DirId)
 	// start of gathering file system events
 	go func() {
 		for {
 			if len(c) == cap(c) {
-				log.Fatal("procHandler -> Buffer is full for ", watchedDir)
-			} else {
-				ei := <-c
-				m.Lock()
-				events = append(events, ei)
-				m.Unlock()
+				// notify drops the events it can't send, so only a walk can tell what changed
+				logger.InfoLog("WARNING: procHandler -> buffer is full, events are lost, reindexing", watchedDir)
+				eventsDropped.Inc(dirLabel)
+				if err := ph.Watcheddb.Exec("UPDATE watched_dirs SET state_id=? WHERE id=? AND state_id=?", 1, ph.DirId, 3); err != nil {
+					logger.InfoLog("WARNING: procHandler -> can't reindex", watchedDir, ":", err)
+				}
 			}
+			ei := <-c
+			eventsReceived.Inc(dirLabel)
+			m.Lock()
+			events = append(events, ei)
+			ph.Progress.Pending(ph.DirId, len(events))
+			m.Unlock()
 		}
 	}()
 
 	for {
-		switch ph.getState() {
+		state, err := ph.getState()
+		if err != nil {
+			logger.InfoLog("WARNING: procHandler -> dir_id", ph.DirId, ":", err)
+			time.Sleep(retryAfter)
+			continue
+		}
+		switch state {
 		case "indexing":
-			ph.index()
+			if err := ph.index(); err != nil {
+				logger.InfoLog("WARNING: index -> dir_id", ph.DirId, ":", err)
+				ph.Progress.Error(ph.DirId)
+				time.Sleep(retryAfter)
+			}
 		case "wiping":
 			ph.wipe()
 			logger.DebugLog("procHandler.handle -> process handling done for dir_id:", ph.DirId)
@@ -67,109 +113,117 @@ func (ph *ProcHandler) Handle() {
 	}
 }
 
-func (ph *ProcHandler) getState() string {
+func (ph *ProcHandler) getState() (string, error) {
+	return ph.watchedDirColumn("state")
+}
 
-	stateSlice := ph.Watcheddb.QueryRow("SELECT state FROM watched_dirs_states WHERE id=?", ph.DirId)
+func (ph *ProcHandler) getWatchedDir() (string, error) {
+	return ph.watchedDirColumn("path_to_dir")
+}
 
-	if state, ok := stateSlice[0].(string); ok != true {
-		log.Fatal("getState -> cannot convert state to string")
-		return ""
-	} else {
-		return state
+func (ph *ProcHandler) watchedDirColumn(column string) (string, error) {
+	row, err := ph.Watcheddb.QueryRow("SELECT "+column+" FROM watched_dirs_states WHERE id=?", ph.DirId)
+	if err != nil {
+		return "", err
+	}
+	if len(row) == 0 {
+		return "", fmt.Errorf("dir_id %d is not watched", ph.DirId)
 	}
+	if value, ok := row[0].(string); ok {
+		return value, nil
+	}
+	return "", fmt.Errorf("the %s of dir_id %d is not a string: %v", column, ph.DirId, row[0])
 }
 
-func (ph *ProcHandler) getWatchedDir() string {
-
-	pathSlice := ph.Watcheddb.QueryRow("SELECT path_to_dir FROM watched_dirs_states WHERE id=?", ph.DirId)
-
-	if path, ok := pathSlice[0].(string); ok != true {
-		log.Fatal("getState -> cannot convert state to string")
-		return ""
-	} else {
-		return path
-	}
+// wiping tells whether the dir is being removed, so the indexing can stop.
+func (ph *ProcHandler) wiping() bool {
+	state, err := ph.getState()
+	return err == nil && state == "wiping"
 }
 
-func (ph *ProcHandler) index() {
+func (ph *ProcHandler) index() error {
 
 	logger.DebugLog("index -> indexing started for dir_id", ph.DirId)
 
 	// Remove from the db the rows whom files does not exist
-	rows := ph.Filesdb.Query("SELECT path_to_file, fname FROM files WHERE dir_id=?", ph.DirId)
+	rows, err := ph.Filesdb.Query("SELECT path_to_file, fname FROM files WHERE dir_id=?", ph.DirId)
+	if err != nil {
+		return err
+	}
+	ph.Progress.StartIndexing(ph.DirId, int64(len(rows)))
 
 	for _, row := range rows {
-		switch ph.getState() {
-		case "wiping":
-			return
-		default:
-			var path, fname string
-
-			if p, ok := row[0].(string); ok != true {
-				log.Fatal("index -> cannot convert path_to_file to string")
-			} else {
-				path = p
-			}
-
-			if f, ok := row[1].(string); ok != true {
-				log.Fatal("index -> cannot convert fname to string")
-			} else {
-				fname = f
-			}
+		if ph.wiping() {
+			return nil
+		}
+		path, pathOk := row[0].(string)
+		fname, fnameOk := row[1].(string)
+		if !pathOk || !fnameOk {
+			logger.InfoLog("WARNING: index -> invalid row of dir_id", ph.DirId, ":", row)
+			continue
+		}
 
-			if _, err := os.Stat(filepath.Join(path, fname)); os.IsNotExist(err) {
-				logger.DebugLog("index", ph.DirId, "-> removing not existing file's index", path, fname)
-				ph.Filesdb.Exec("DELETE FROM files WHERE path_to_file=? AND fname=?", path, fname)
-			}
+		if _, err := os.Stat(filepath.Join(path, fname)); os.IsNotExist(err) {
+			logger.DebugLog("index", ph.DirId, "-> removing not existing file's index", path, fname)
+			ph.Filesdb.Exec("DELETE FROM files WHERE path_to_file=? AND fname=?", path, fname)
 		}
 	}
 
 	// Walk recursively on filepath, and insert/update files found
-	watchedRoot := ph.getWatchedDir()
-	err := filepath.Walk(watchedRoot,
+	watchedRoot, err := ph.getWatchedDir()
+	if err != nil {
+		return err
+	}
+	err = filepath.Walk(watchedRoot,
 		func(path string, info os.FileInfo, err error) error {
-			switch ph.getState() {
-			case "wiping":
+			if ph.wiping() {
 				return io.EOF
-			default:
-				if err != nil {
-					logger.InfoLog("index -> ", err)
-					return nil
-				} else {
-					dir, file := filepath.Split(path)
-					size := info.Size()
-					mtimens := info.ModTime().UnixNano()
-					isDir := info.IsDir()
-
-					logger.DebugLog("index", ph.DirId, "-> file inserted/updated: ", dir, file)
-					ph.Filesdb.Exec("INSERT into files (dir_id, path_to_file, fname, size, mtime_ns, is_dir) VALUES (?,?,?,?,?,?)"+
-						"ON CONFLICT(path_to_file, fname) DO UPDATE SET size = ?, mtime_ns = ?",
-						ph.DirId, dir, file, size, mtimens, isDir, size, mtimens)
-
-					return nil
-				}
 			}
+			if err != nil {
+				logger.InfoLog("index -> ", err)
+				ph.Progress.Error(ph.DirId)
+				return nil
+			}
+			dir, file := filepath.Split(path)
+
+			logger.DebugLog("index", ph.DirId, "-> file inserted/updated: ", dir, file)
+			ph.upsert(dir, file, info)
+			size := info.Size()
+			if info.IsDir() {
+				size = 0
+			}
+			ph.Progress.Scanned(ph.DirId, path, size)
+			return nil
 		})
 
 	if err == io.EOF {
 		// the directory marked for 'wiping'
-		return
+		return nil
 	} else if err != nil {
-		log.Fatal("index -> ", err)
+		return err
 	}
 
-	if state := ph.getState(); state == "indexing" {
+	if state, err := ph.getState(); err != nil {
+		return err
+	} else if state == "indexing" {
 		//TODO: 3-at lecserelni
-		ph.Watcheddb.Exec("UPDATE watched_dirs SET state_id=? WHERE id=?", 3, ph.DirId)
+		if err := ph.Watcheddb.Exec("UPDATE watched_dirs SET state_id=? WHERE id=?", 3, ph.DirId); err != nil {
+			return err
+		}
 	}
+	ph.Progress.DoneIndexing(ph.DirId)
 	logger.DebugLog("index -> indexing done for dir_id", ph.DirId)
+	return nil
 }
 
 func (ph *ProcHandler) wipe() {
 	logger.DebugLog("wipe -> wipe for ", ph.DirId, " id started")
 	ph.Filesdb.Exec("DELETE FROM files WHERE dir_id=?", ph.DirId)
+	ph.Progress.Remove(ph.DirId)
 	ph.DoneID <- ph.DirId
-	ph.Watcheddb.Exec("DELETE FROM watched_dirs WHERE id =?", ph.DirId)
+	if err := ph.Watcheddb.Exec("DELETE FROM watched_dirs WHERE id =?", ph.DirId); err != nil {
+		logger.InfoLog("WARNING: wipe -> can't delete the watched dir", ph.DirId, ":", err)
+	}
 	logger.DebugLog("wipe -> wipe for id", ph.DirId, "done")
 }
 
@@ -179,30 +233,99 @@ func (ph *ProcHandler) update(events *[]notify.EventInfo, m *sync.Mutex) {
 	if len(*events) > 0 {
 		event := (*events)[0]
 		*events = (*events)[1:]
+		ph.Progress.Pending(ph.DirId, len(*events))
 		m.Unlock()
 		logger.DebugLog("update -> the following event handled: ", event)
+		eventsApplied.Inc(strconv.Itoa(ph.DirId))
 		path, fname := filepath.Split(event.Path())
 
+		change := fsevents.Change{Op: fsevents.Removed, DirId: ph.DirId, Path: path, Fname: fname, Time: time.Now()}
 		switch event.Event() {
 		case notify.Remove:
+			ph.lastIndexed(&change)
 			ph.Filesdb.Exec("DELETE FROM files WHERE path_to_file=? AND fname=?", path, fname)
 		default:
 			if fileStat, err := os.Stat(event.Path()); err != nil {
 				// the file was deleted or it's permission changed since event was recorded
+				ph.lastIndexed(&change)
 				ph.Filesdb.Exec("DELETE FROM files WHERE path_to_file=? AND fname=?", path, fname)
 			} else {
-				size := fileStat.Size()
-				mtimens := fileStat.ModTime().UnixNano()
-				isDir := fileStat.IsDir()
+				ph.upsert(path, fname, fileStat)
+
+				change.Op = fsevents.Modified
+				if event.Event() == notify.Create || event.Event() == notify.Rename {
+					// a file moved here is new at this path
+					change.Op = fsevents.Created
+				}
+				change.Size, change.MtimeNs, change.IsDir = fileStat.Size(), fileStat.ModTime().UnixNano(), fileStat.IsDir()
+			}
+		}
 
-				ph.Filesdb.Exec("INSERT into files (dir_id, path_to_file, fname, size, mtime_ns, is_dir) VALUES (?,?,?,?,?,?)"+
-					"ON CONFLICT(path_to_file, fname) DO UPDATE SET size = ?, mtime_ns = ?",
-					ph.DirId, path, fname, size, mtimens, isDir, size, mtimens)
+		if cookie, moved := moveCookie(event); moved && change.Op != fsevents.Modified {
+			if ph.moveHalf != nil && ph.moveCookie == cookie && ph.moveHalf.Op != change.Op {
+				ph.publishRename(*ph.moveHalf, change)
+				ph.moveHalf = nil
+				return
 			}
+			ph.publishMoveHalf()
+			// the other half may come next
+			ph.moveHalf, ph.moveCookie = &change, cookie
+			return
 		}
+		ph.publishMoveHalf()
+		ph.Events.Publish(change)
 	} else {
 		m.Unlock()
+		// the other half of the move is outside of the watched dir
+		ph.publishMoveHalf()
 		time.Sleep(20 * time.Millisecond)
 	}
 
 }
+
+// lastIndexed sets the size, mtime and type of the removed file of c to the
+// ones it was indexed with, so the saved searches with conditions on them
+// match its removal too. They stay zero if it's not in the committed index.
+func (ph *ProcHandler) lastIndexed(c *fsevents.Change) {
+	row, err := ph.Filesdb.QueryRow("SELECT size, mtime_ns, is_dir FROM files WHERE path_to_file=? AND fname=?", c.Path, c.Fname)
+	if err != nil || len(row) == 0 {
+		return
+	}
+	var size, mtimeNs int64
+	var isDir bool
+	if err := dbconnect.Scan(row, &size, &mtimeNs, &isDir); err != nil {
+		logger.InfoLog("WARNING: update -> invalid row of", c.Path, c.Fname, ":", err)
+		return
+	}
+	c.Size, c.MtimeNs, c.IsDir = size, mtimeNs, isDir
+}
+
+func (ph *ProcHandler) publishMoveHalf() {
+	if ph.moveHalf != nil {
+		ph.Events.Publish(*ph.moveHalf)
+		ph.moveHalf = nil
+	}
+}
+
+// publishRename publishes the two halves of a move, the removal of the old name
+// and the creation of the new one, in any order, as a rename.
+func (ph *ProcHandler) publishRename(a, b fsevents.Change) {
+	if a.Op == fsevents.Removed {
+		a, b = b, a
+	}
+	a.Op, a.OldPath, a.OldFname = fsevents.Renamed, b.Path, b.Fname
+	ph.Events.Publish(a)
+}
+
+// upsert inserts or updates the row of the file.
+func (ph *ProcHandler) upsert(dir, fname string, info os.FileInfo) {
+	// the owner is NULL where it's unknown
+	var uid, gid interface{}
+	if u, g, ok := access.Owner(info); ok {
+		uid, gid = u, g
+	}
+
+	ph.Filesdb.Exec("INSERT into files (dir_id, path_to_file, fname, path_key, fname_key, size, mtime_ns, is_dir, mode, uid, gid) VALUES (?,?,?,?,?,?,?,?,?,?,?)"+
+		"ON CONFLICT(path_to_file, fname) DO UPDATE SET size = excluded.size, mtime_ns = excluded.mtime_ns, mode = excluded.mode, uid = excluded.uid, gid = excluded.gid",
+		ph.DirId, dir, fname, textfold.Key(dir), textfold.Key(fname), info.Size(), info.ModTime().UnixNano(), info.IsDir(), uint32(info.Mode().Perm()), uid, gid)
+}
@@ -0,0 +1,56 @@
+package prochandler
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/rjeczalik/notify"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/dbconnect"
+	"github.com/ariadne-tools/ariadne-daemon/internal/fsevents"
+)
+
+// event is a file system event as notify reports it.
+type event struct {
+	e    notify.Event
+	path string
+}
+
+func (e event) Event() notify.Event { return e.e }
+func (e event) Path() string        { return e.path }
+func (e event) Sys() interface{}    { return nil }
+
+func TestUpdateRemoved(t *testing.T) {
+	db := dbconnect.NewDbConnector(filepath.Join(t.TempDir(), "files.db"), 0, nil)
+	defer db.DB.Close()
+	if err := db.Migrate(dbconnect.FilesMigrations); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "dl") + "/"
+	if err := db.Exec("INSERT INTO files (dir_id, path_to_file, fname, size, mtime_ns, is_dir) VALUES (1, ?, 'big.iso', 2048, 7, 0)", dir); err != nil {
+		t.Fatal(err)
+	}
+
+	bus := fsevents.NewBus()
+	changes := bus.Subscribe(10)
+	ph := ProcHandler{DirId: 1, Filesdb: db, Events: bus}
+	var mu sync.Mutex
+	events := []notify.EventInfo{
+		event{notify.Remove, dir + "big.iso"},
+		event{notify.Remove, dir + "unknown.iso"},
+	}
+	ph.update(&events, &mu)
+	ph.update(&events, &mu)
+
+	// the removed file is matched by its last indexed attributes
+	if c := <-changes; c.Op != fsevents.Removed || c.Fname != "big.iso" || c.Size != 2048 || c.MtimeNs != 7 {
+		t.Errorf("the removal of an indexed file is %+v", c)
+	}
+	if c := <-changes; c.Op != fsevents.Removed || c.Fname != "unknown.iso" || c.Size != 0 {
+		t.Errorf("the removal of a file not in the index is %+v", c)
+	}
+	if rows, _ := db.Query("SELECT fname FROM files"); len(rows) != 0 {
+		t.Errorf("the removed file is left in the index: %v", rows)
+	}
+}
@@ -0,0 +1,134 @@
+package progress
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Dir is the progress of the procHandler of a watched dir. The counters are
+// those of the last indexing, the running one while State is indexing.
+type Dir struct {
+	DirId         int
+	Path          string
+	State         string
+	StartTime     time.Time // when the last indexing started
+	EndTime       time.Time // when it finished, zero while it's running
+	Indexed       bool      // an indexing finished since the daemon started
+	FilesScanned  int64
+	BytesSeen     int64
+	Errors        int64
+	CurrentPath   string
+	PendingEvents int // the file system events waiting to be applied
+
+	// The estimates are based on the number of files the dir had in the index
+	// before, they are -1 while unknown, e.g. at the first indexing.
+	EstimatedRemainingFiles int64
+	EstimatedRemainingMs    int64
+}
+
+// Tracker holds the progress of every procHandler. A nil *Tracker tracks nothing.
+type Tracker struct {
+	mu   sync.Mutex
+	dirs map[int]*Dir
+	// the files of the dirs in the index when their indexing started
+	expected map[int]int64
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{dirs: make(map[int]*Dir), expected: make(map[int]int64)}
+}
+
+// update calls f with the progress of the dir, creating it if needed.
+func (t *Tracker) update(dirId int, f func(d *Dir)) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d, in := t.dirs[dirId]
+	if !in {
+		d = &Dir{DirId: dirId}
+		t.dirs[dirId] = d
+	}
+	f(d)
+}
+
+// StartIndexing resets the counters of the dir. expected is the number of its
+// files in the index, 0 if there are none yet.
+func (t *Tracker) StartIndexing(dirId int, expected int64) {
+	t.update(dirId, func(d *Dir) {
+		*d = Dir{DirId: dirId, StartTime: time.Now(), Indexed: d.Indexed, PendingEvents: d.PendingEvents}
+		t.expected[dirId] = expected
+	})
+}
+
+// Scanned counts a file or directory found by the indexing.
+func (t *Tracker) Scanned(dirId int, path string, size int64) {
+	t.update(dirId, func(d *Dir) {
+		d.FilesScanned++
+		d.BytesSeen += size
+		d.CurrentPath = path
+	})
+}
+
+// Error counts a file the procHandler failed to read.
+func (t *Tracker) Error(dirId int) {
+	t.update(dirId, func(d *Dir) { d.Errors++ })
+}
+
+// DoneIndexing marks the end of the indexing of the dir.
+func (t *Tracker) DoneIndexing(dirId int) {
+	t.update(dirId, func(d *Dir) {
+		d.EndTime, d.CurrentPath, d.Indexed = time.Now(), "", true
+	})
+}
+
+// Pending sets the number of the events of the dir waiting to be applied.
+func (t *Tracker) Pending(dirId int, n int) {
+	t.update(dirId, func(d *Dir) { d.PendingEvents = n })
+}
+
+// Remove forgets the dir, once it's no longer watched.
+func (t *Tracker) Remove(dirId int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	delete(t.dirs, dirId)
+	delete(t.expected, dirId)
+	t.mu.Unlock()
+}
+
+// Dirs returns a copy of the progress of the dirs, ordered by their ids, with
+// the estimates computed.
+func (t *Tracker) Dirs() []Dir {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	dirs := make([]Dir, 0, len(t.dirs))
+	for id, d := range t.dirs {
+		dir := *d
+		dir.EstimatedRemainingFiles, dir.EstimatedRemainingMs = -1, -1
+		switch expected := t.expected[id]; {
+		case !dir.EndTime.IsZero():
+			dir.EstimatedRemainingFiles, dir.EstimatedRemainingMs = 0, 0
+		case dir.StartTime.IsZero() || expected == 0:
+		case dir.FilesScanned >= expected:
+			// more files than before, it can't be told how many more
+		default:
+			dir.EstimatedRemainingFiles = expected - dir.FilesScanned
+			if dir.FilesScanned > 0 {
+				elapsed := now.Sub(dir.StartTime)
+				dir.EstimatedRemainingMs = int64(elapsed/time.Millisecond) * dir.EstimatedRemainingFiles / dir.FilesScanned
+			}
+		}
+		dirs = append(dirs, dir)
+	}
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].DirId < dirs[j].DirId })
+	return dirs
+}
@@ -0,0 +1,265 @@
+package savedsearch
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/dbconnect"
+	"github.com/ariadne-tools/ariadne-daemon/internal/fsevents"
+	"github.com/ariadne-tools/ariadne-daemon/internal/logger"
+	"github.com/ariadne-tools/ariadne-daemon/internal/search"
+	"github.com/ariadne-tools/ariadne-daemon/internal/textfold"
+)
+
+const (
+	HitBuffer    = 1024        // the number of the latest hits kept for the clients
+	MaxWait      = time.Minute // the longest a client can wait for new hits
+	EventsBuffer = 4096        // the changes waiting to be matched
+	dropCheck    = time.Second // how often the changes dropped by the bus are looked for
+)
+
+// SavedSearch is a search request the changes of the files are matched against.
+// Only its conditions count: Limit and Cursor are ignored.
+type SavedSearch struct {
+	Id      int
+	Name    string
+	Request search.Request
+}
+
+// Hit is a change of a file matching a saved search. The hits are numbered
+// by Seq in the order they were found.
+type Hit struct {
+	Seq      uint64
+	SearchId int
+	Change   fsevents.Change
+}
+
+// Notifier matches the changes of the files against the saved searches of
+// watched_dirs.db, and keeps the latest hits until the clients fetch them.
+type Notifier struct {
+	db      *dbconnect.DbConnector
+	scratch *sql.DB // the conditions are evaluated on a single row here
+
+	mu       sync.Mutex
+	searches map[int]SavedSearch
+	hits     []Hit
+	seq      uint64        // the Seq of the last hit
+	lostSeq  uint64        // the Seq taken when changes were dropped last, there's no hit with it
+	wake     chan struct{} // closed when new hits arrive
+}
+
+func NewNotifier(watcheddb *dbconnect.DbConnector) (*Notifier, error) {
+	scratch, err := dbconnect.OpenScratch()
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Notifier{db: watcheddb, scratch: scratch, searches: make(map[int]SavedSearch), wake: make(chan struct{})}
+	rows, err := watcheddb.Query("SELECT id, name, request FROM saved_searches")
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		var s SavedSearch
+		var request string
+		if err := dbconnect.Scan(row, &s.Id, &s.Name, &request); err != nil {
+			return nil, fmt.Errorf("saved search: %v", err)
+		}
+		if err := json.Unmarshal([]byte(request), &s.Request); err != nil {
+			return nil, fmt.Errorf("saved search %d: %v", s.Id, err)
+		}
+		n.searches[s.Id] = s
+	}
+	return n, nil
+}
+
+// Add saves the search and returns its id.
+func (n *Notifier) Add(name string, req search.Request) (int, error) {
+	req.Limit, req.Cursor, req.Id = 0, "", ""
+	if _, _, err := req.Where(search.Index{}); err != nil {
+		return 0, err
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return 0, err
+	}
+
+	// Exec can't tell the id of the new row
+	n.db.Lock()
+	res, err := n.db.DB.Exec("INSERT INTO saved_searches (name, request) VALUES (?,?)", name, string(b))
+	n.db.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	n.mu.Lock()
+	n.searches[int(id)] = SavedSearch{int(id), name, req}
+	n.mu.Unlock()
+	logger.DebugLog("notifier.add -> saved search added:", id, name)
+	return int(id), nil
+}
+
+// Remove deletes the saved search, and reports whether it existed. The search
+// is kept if it can't be deleted from the db.
+func (n *Notifier) Remove(id int) (bool, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, in := n.searches[id]; !in {
+		return false, nil
+	}
+	if err := n.db.Exec("DELETE FROM saved_searches WHERE id=?", id); err != nil {
+		return false, err
+	}
+	delete(n.searches, id)
+	return true, nil
+}
+
+// List returns the saved searches in the order they were added.
+func (n *Notifier) List() []SavedSearch {
+	n.mu.Lock()
+	list := make([]SavedSearch, 0, len(n.searches))
+	for _, s := range n.searches {
+		list = append(list, s)
+	}
+	n.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list
+}
+
+// Run matches the changes published on bus. If the bus drops changes because
+// they aren't matched fast enough, the hits after them are Lost.
+func (n *Notifier) Run(bus *fsevents.Bus) {
+	events := bus.Subscribe(EventsBuffer)
+	check := time.NewTicker(dropCheck)
+	defer check.Stop()
+	for {
+		select {
+		case change, open := <-events:
+			if !open {
+				return
+			}
+			n.lose(bus.Dropped(events))
+			n.match(change)
+		case <-check.C:
+			n.lose(bus.Dropped(events))
+		}
+	}
+}
+
+func (n *Notifier) match(change fsevents.Change) {
+	var matching []int
+	for _, s := range n.List() {
+		if n.matches(s.Request, change) {
+			matching = append(matching, s.Id)
+		}
+	}
+	if len(matching) == 0 {
+		return
+	}
+
+	n.mu.Lock()
+	for _, id := range matching {
+		n.seq++
+		n.hits = append(n.hits, Hit{n.seq, id, change})
+	}
+	if len(n.hits) > HitBuffer {
+		n.hits = append([]Hit(nil), n.hits[len(n.hits)-HitBuffer:]...)
+	}
+	n.wakeUp()
+	n.mu.Unlock()
+}
+
+// lose takes a Seq without a hit for the dropped changes, if there are any,
+// so the clients waiting for hits after it are told that some may be lost.
+func (n *Notifier) lose(dropped uint64) {
+	if dropped == 0 {
+		return
+	}
+	logger.InfoLog("WARNING: notifier -> the saved searches are lagging behind,", dropped, "changes were dropped")
+	n.mu.Lock()
+	n.seq++
+	n.lostSeq = n.seq
+	n.wakeUp()
+	n.mu.Unlock()
+}
+
+// wakeUp wakes the clients waiting in Hits, n.mu has to be locked.
+func (n *Notifier) wakeUp() {
+	close(n.wake)
+	n.wake = make(chan struct{})
+}
+
+// matches evaluates the conditions of req on a row made of the change.
+func (n *Notifier) matches(req search.Request, c fsevents.Change) bool {
+	where, args, err := req.Where(search.Index{})
+	if err != nil {
+		// the request was valid when it was added, only the time may have changed since
+		logger.InfoLog("notifier.matches -> ", err)
+		return false
+	}
+
+	row := []interface{}{c.DirId, c.Path, c.Fname, textfold.Key(c.Path), textfold.Key(c.Fname), c.Size, c.MtimeNs, c.IsDir}
+	q := "SELECT 1 FROM (SELECT ? AS dir_id, ? AS path_to_file, ? AS fname, ? AS path_key, ? AS fname_key, " +
+		"? AS size, ? AS mtime_ns, ? AS is_dir) AS files WHERE " + where
+
+	var one int
+	err = n.scratch.QueryRow(q, append(row, args...)...).Scan(&one)
+	if err != nil && err != sql.ErrNoRows {
+		logger.InfoLog("notifier.matches -> ", err)
+	}
+	return err == nil
+}
+
+// Hits returns the hits after the since-th one of the given saved searches (of
+// all of them if ids is empty). If there are none, it waits at most wait for
+// them. It also returns the Seq to ask for the next time, and whether some hits
+// after since were lost: dropped from the buffer already, or never found
+// because the changes were dropped before they were matched. Then it returns
+// without waiting, and the client has to run the searches again to catch up.
+func (n *Notifier) Hits(since uint64, ids []int, wait time.Duration) ([]Hit, uint64, bool) {
+	if wait > MaxWait {
+		wait = MaxWait
+	}
+	wanted := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+
+	lost := false
+	for {
+		n.mu.Lock()
+		var hits []Hit
+		for _, h := range n.hits {
+			if h.Seq > since && (len(ids) == 0 || wanted[h.SearchId]) {
+				hits = append(hits, h)
+			}
+		}
+		if len(n.hits) > 0 && n.hits[0].Seq > since+1 || n.lostSeq > since {
+			lost = true
+		}
+		since = n.seq
+		wake := n.wake
+		n.mu.Unlock()
+
+		if len(hits) > 0 || lost {
+			return hits, since, lost
+		}
+		select {
+		case <-wake:
+		case <-timeout.C:
+			return nil, since, lost
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package savedsearch
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/dbconnect"
+	"github.com/ariadne-tools/ariadne-daemon/internal/fsevents"
+	"github.com/ariadne-tools/ariadne-daemon/internal/search"
+)
+
+func newTestNotifier(t *testing.T) (*Notifier, *dbconnect.DbConnector) {
+	t.Helper()
+	db := dbconnect.NewDbConnector(filepath.Join(t.TempDir(), "watched_dirs.db"), 0, nil)
+	t.Cleanup(func() { db.DB.Close() })
+	if err := db.Migrate(dbconnect.WatchedMigrations); err != nil {
+		t.Fatal(err)
+	}
+	n, err := NewNotifier(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n, db
+}
+
+func TestRemove(t *testing.T) {
+	n, db := newTestNotifier(t)
+	id, err := n.Add("go", search.Request{Pattern: "*.go", Mode: search.Glob})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the db can't be written
+	if err := db.Exec("CREATE TRIGGER keep BEFORE DELETE ON saved_searches BEGIN SELECT RAISE(ABORT, 'read only'); END"); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := n.Remove(id); err == nil || removed {
+		t.Errorf("Remove reported %v, %v when the delete failed", removed, err)
+	}
+	if len(n.List()) != 1 {
+		t.Errorf("the search is gone though it's still in the db")
+	}
+
+	if err := db.Exec("DROP TRIGGER keep"); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := n.Remove(id); err != nil || !removed {
+		t.Errorf("Remove reported %v, %v", removed, err)
+	}
+	if removed, err := n.Remove(id); err != nil || removed {
+		t.Errorf("Remove of a removed search reported %v, %v", removed, err)
+	}
+	if rows, _ := db.Query("SELECT id FROM saved_searches"); len(rows) != 0 {
+		t.Errorf("the search is left in the db: %v", rows)
+	}
+}
+
+func TestHitsLost(t *testing.T) {
+	n, _ := newTestNotifier(t)
+	id, err := n.Add("go", search.Request{Pattern: "*.go", Mode: search.Glob})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.match(fsevents.Change{Op: fsevents.Created, Path: "/src/", Fname: "a.go"})
+	hits, next, lost := n.Hits(0, nil, 0)
+	if len(hits) != 1 || hits[0].SearchId != id || lost {
+		t.Fatalf("got %v, lost %v", hits, lost)
+	}
+
+	// the changes the notifier couldn't keep up with
+	n.lose(5)
+	start := time.Now()
+	hits, next, lost = n.Hits(next, nil, time.Minute)
+	if !lost || len(hits) != 0 {
+		t.Errorf("got %v, lost %v after the changes were dropped", hits, lost)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("waited for hits though some were lost")
+	}
+	n.match(fsevents.Change{Op: fsevents.Created, Path: "/src/", Fname: "b.go"})
+	if hits, _, lost = n.Hits(next, nil, 0); len(hits) != 1 || lost {
+		t.Errorf("got %v, lost %v after the drop was told", hits, lost)
+	}
+}
+
+func TestRemovedMatchesLastIndexed(t *testing.T) {
+	n, _ := newTestNotifier(t)
+	minSize := int64(100)
+	req := search.Request{Pattern: "*.iso", Mode: search.Glob, MinSize: &minSize}
+	removed := fsevents.Change{Op: fsevents.Removed, Path: "/dl/", Fname: "big.iso", Size: 1 << 30, MtimeNs: 1}
+	if !n.matches(req, removed) {
+		t.Errorf("the removal of a big file doesn't match %+v", req)
+	}
+	removed.Size = 0
+	if n.matches(req, removed) {
+		t.Errorf("the removal of a file of an unknown size matches %+v", req)
+	}
+}
@@ -0,0 +1,384 @@
+package search
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The query language combines terms with implicit AND, OR, NOT (or a leading
+// '-') and parentheses. A term is either a word, which the filename has to
+// contain (or match, if it has glob wildcards), or a key:value filter:
+//
+//	ext:go,rs             the extension is one of the listed ones
+//	size:>10M size:1K..2G the size is in the range (units are powers of 1024)
+//	modified:<7d          modified less than 7 days ago (s, min, h, d, w, y)
+//	modified:>2023-01-01  modified after the date (or date..date)
+//	path:/src             the full path contains the text
+//	type:dir type:file    the entry is a directory or not
+//	re:^test_\d+          the filename matches the regular expression
+//
+// Words and values can be quoted with double quotes, e.g. path:"my docs".
+
+type tokenKind int
+
+const (
+	tokWord tokenKind = iota
+	tokNot
+	tokOpen
+	tokClose
+)
+
+type token struct {
+	kind   tokenKind
+	key    string // the key of a key:value filter
+	text   string
+	quoted bool
+}
+
+func lex(q string) ([]token, error) {
+	var tokens []token
+	runes := []rune(q)
+
+	for i := 0; i < len(runes); {
+		switch r := runes[i]; {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{kind: tokOpen})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{kind: tokClose})
+			i++
+		case r == '-' && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]):
+			tokens = append(tokens, token{kind: tokNot})
+			i++
+		default:
+			var b strings.Builder
+			key := ""
+			quoted := false
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && runes[i] != '(' && runes[i] != ')' {
+				if runes[i] == ':' && key == "" && !quoted && isKey(b.String()) {
+					key = b.String()
+					b.Reset()
+					i++
+					continue
+				}
+				if runes[i] != '"' {
+					b.WriteRune(runes[i])
+					i++
+					continue
+				}
+				quoted = true
+				end := i + 1
+				for end < len(runes) && runes[end] != '"' {
+					end++
+				}
+				if end == len(runes) {
+					return nil, fmt.Errorf("search: unterminated quote in query")
+				}
+				b.WriteString(string(runes[i+1 : end]))
+				i = end + 1
+			}
+			tokens = append(tokens, token{kind: tokWord, key: key, text: b.String(), quoted: quoted})
+		}
+	}
+	return tokens, nil
+}
+
+func isKey(s string) bool {
+	for _, r := range s {
+		if r < 'a' || r > 'z' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// condition is a compiled part of a query.
+type condition struct {
+	sql  string
+	args []interface{}
+}
+
+type parser struct {
+	tokens        []token
+	pos           int
+	caseSensitive bool
+	now           time.Time
+	idx           Index
+}
+
+func (p *parser) peek() (token, bool) {
+	if p.pos == len(p.tokens) {
+		return token{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *parser) isKeyword(t token, keyword string) bool {
+	return t.kind == tokWord && t.key == "" && !t.quoted && t.text == keyword
+}
+
+// compileQuery parses the query and compiles it into an SQL condition over the files table.
+func compileQuery(q string, caseSensitive bool, idx Index, now time.Time) (condition, error) {
+	tokens, err := lex(q)
+	if err != nil {
+		return condition{}, err
+	}
+	if len(tokens) == 0 {
+		return condition{}, fmt.Errorf("search: empty query")
+	}
+
+	p := parser{tokens: tokens, caseSensitive: caseSensitive, now: now, idx: idx}
+	c, err := p.parseOr()
+	if err != nil {
+		return condition{}, err
+	}
+	if t, more := p.peek(); more {
+		if t.kind == tokClose {
+			return condition{}, fmt.Errorf("search: unbalanced ')' in query")
+		}
+		return condition{}, fmt.Errorf("search: unexpected %q in query", t.text)
+	}
+	return c, nil
+}
+
+func (p *parser) parseOr() (condition, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return condition{}, err
+	}
+	for {
+		t, more := p.peek()
+		if !more || !p.isKeyword(t, "OR") {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return condition{}, err
+		}
+		left = condition{"(" + left.sql + " OR " + right.sql + ")", append(left.args, right.args...)}
+	}
+}
+
+func (p *parser) parseAnd() (condition, error) {
+	var conds []condition
+	for {
+		t, more := p.peek()
+		if !more || t.kind == tokClose || p.isKeyword(t, "OR") {
+			break
+		}
+		if p.isKeyword(t, "AND") {
+			p.pos++
+			continue
+		}
+		c, err := p.parseUnary()
+		if err != nil {
+			return condition{}, err
+		}
+		conds = append(conds, c)
+	}
+
+	if len(conds) == 0 {
+		return condition{}, fmt.Errorf("search: missing term in query")
+	}
+	sqls := make([]string, 0, len(conds))
+	var args []interface{}
+	for _, c := range conds {
+		sqls = append(sqls, c.sql)
+		args = append(args, c.args...)
+	}
+	return condition{"(" + strings.Join(sqls, " AND ") + ")", args}, nil
+}
+
+func (p *parser) parseUnary() (condition, error) {
+	t, _ := p.peek()
+	if t.kind == tokNot || p.isKeyword(t, "NOT") {
+		p.pos++
+		if _, more := p.peek(); !more {
+			return condition{}, fmt.Errorf("search: missing term after NOT in query")
+		}
+		c, err := p.parseUnary()
+		if err != nil {
+			return condition{}, err
+		}
+		return condition{"NOT " + c.sql, c.args}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (condition, error) {
+	t, _ := p.peek()
+	p.pos++
+	switch t.kind {
+	case tokOpen:
+		c, err := p.parseOr()
+		if err != nil {
+			return condition{}, err
+		}
+		if t, more := p.peek(); !more || t.kind != tokClose {
+			return condition{}, fmt.Errorf("search: missing ')' in query")
+		}
+		p.pos++
+		return c, nil
+	case tokClose:
+		return condition{}, fmt.Errorf("search: unbalanced ')' in query")
+	default:
+		return p.term(t)
+	}
+}
+
+func (p *parser) term(t token) (condition, error) {
+	value := t.text
+	switch t.key {
+	case "":
+		mode := Substring
+		if strings.ContainsAny(value, "*?[") {
+			mode = Glob
+		}
+		sql, args, err := matchName(nameTarget, mode, value, p.caseSensitive, p.idx)
+		return condition{sql, args}, err
+	case "ext":
+		var sqls []string
+		var args []interface{}
+		for _, ext := range strings.Split(value, ",") {
+			if ext = strings.TrimPrefix(ext, "."); ext == "" {
+				return condition{}, fmt.Errorf("search: empty extension in %q", value)
+			}
+			sql, extArgs, _ := matchName(nameTarget, Glob, "*."+escapeGlob(ext), p.caseSensitive, p.idx)
+			sqls = append(sqls, sql)
+			args = append(args, extArgs...)
+		}
+		return condition{"(" + strings.Join(sqls, " OR ") + ")", args}, nil
+	case "size":
+		return rangeCondition("size", value, parseSize)
+	case "modified":
+		return p.modifiedCondition(value)
+	case "path":
+		sql, args, _ := matchName(pathTarget, Substring, value, p.caseSensitive, p.idx)
+		return condition{sql, args}, nil
+	case "type":
+		switch value {
+		case "dir", "d":
+			return condition{"is_dir = 1", nil}, nil
+		case "file", "f":
+			return condition{"is_dir = 0", nil}, nil
+		}
+		return condition{}, fmt.Errorf("search: type has to be file or dir, not %q", value)
+	case "re":
+		sql, args, err := matchName(nameTarget, Regex, value, p.caseSensitive, p.idx)
+		return condition{sql, args}, err
+	default:
+		return condition{}, fmt.Errorf("search: unknown filter %q in query", t.key)
+	}
+}
+
+func escapeGlob(s string) string {
+	return strings.NewReplacer(`*`, `[*]`, `?`, `[?]`, `[`, `[[]`).Replace(s)
+}
+
+// rangeCondition compiles a comparison (<, <=, >, >=, =, or nothing for =) or
+// a range (lo..hi) of the column.
+func rangeCondition(column, value string, parse func(string) (int64, error)) (condition, error) {
+	if bounds := strings.SplitN(value, "..", 2); len(bounds) == 2 {
+		l, err := parse(bounds[0])
+		if err != nil {
+			return condition{}, err
+		}
+		h, err := parse(bounds[1])
+		if err != nil {
+			return condition{}, err
+		}
+		return condition{"(" + column + " >= ? AND " + column + " <= ?)", []interface{}{l, h}}, nil
+	}
+
+	op := "="
+	for _, o := range []string{"<=", ">=", "<", ">", "="} {
+		if strings.HasPrefix(value, o) {
+			op, value = o, value[len(o):]
+			break
+		}
+	}
+	v, err := parse(value)
+	if err != nil {
+		return condition{}, err
+	}
+	return condition{column + " " + op + " ?", []interface{}{v}}, nil
+}
+
+var sizeUnits = map[string]int64{
+	"": 1, "b": 1,
+	"k": 1 << 10, "kb": 1 << 10, "kib": 1 << 10,
+	"m": 1 << 20, "mb": 1 << 20, "mib": 1 << 20,
+	"g": 1 << 30, "gb": 1 << 30, "gib": 1 << 30,
+	"t": 1 << 40, "tb": 1 << 40, "tib": 1 << 40,
+}
+
+func parseSize(s string) (int64, error) {
+	num, unit := splitNumber(s)
+	n, err := strconv.ParseFloat(num, 64)
+	m, known := sizeUnits[strings.ToLower(unit)]
+	if err != nil || !known || n < 0 {
+		return 0, fmt.Errorf("search: invalid size %q", s)
+	}
+	return int64(n * float64(m)), nil
+}
+
+var ageUnits = map[string]time.Duration{
+	"s":   time.Second,
+	"min": time.Minute,
+	"h":   time.Hour,
+	"d":   24 * time.Hour,
+	"w":   7 * 24 * time.Hour,
+	"y":   365 * 24 * time.Hour,
+}
+
+func parseAge(s string) (time.Duration, error) {
+	num, unit := splitNumber(s)
+	n, err := strconv.ParseFloat(num, 64)
+	u, known := ageUnits[strings.ToLower(unit)]
+	if err != nil || !known || n < 0 {
+		return 0, fmt.Errorf("search: invalid age %q", s)
+	}
+	return time.Duration(n * float64(u)), nil
+}
+
+func splitNumber(s string) (string, string) {
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return !unicode.IsDigit(r) && r != '.'
+	})
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i:]
+}
+
+// modifiedCondition compiles an age (<7d: newer than 7 days) or a date
+// (>2023-01-01: newer than the date) condition on mtime_ns.
+func (p *parser) modifiedCondition(value string) (condition, error) {
+	timestamp := func(s string) (int64, error) {
+		if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+			return t.UnixNano(), nil
+		}
+		return 0, fmt.Errorf("search: invalid date %q", s)
+	}
+
+	trimmed := strings.TrimLeft(value, "<>=")
+	if _, err := parseAge(strings.SplitN(trimmed, "..", 2)[0]); err != nil {
+		return rangeCondition("mtime_ns", value, timestamp)
+	}
+
+	// an age counts backwards, so the comparisons have to be flipped
+	flipped := strings.NewReplacer("<", ">", ">", "<").Replace(value)
+	if bounds := strings.SplitN(value, "..", 2); len(bounds) == 2 {
+		flipped = bounds[1] + ".." + bounds[0]
+	}
+	return rangeCondition("mtime_ns", flipped, func(s string) (int64, error) {
+		age, err := parseAge(s)
+		return p.now.Add(-age).UnixNano(), err
+	})
+}
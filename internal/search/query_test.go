@@ -0,0 +1,174 @@
+package search
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/dbconnect"
+	"github.com/ariadne-tools/ariadne-daemon/internal/textfold"
+)
+
+var testNow = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+type testFile struct {
+	path  string
+	size  int64
+	age   time.Duration
+	isDir bool
+}
+
+var testFiles = []testFile{
+	{"/home/me/src/api/handler.go", 2 << 10, time.Hour, false},
+	{"/home/me/src/api/handler_test.go", 4 << 10, 48 * time.Hour, false},
+	{"/home/me/src/api", 0, time.Hour, true},
+	{"/home/me/src/lib.rs", 20 << 20, 30 * 24 * time.Hour, false},
+	{"/home/me/my docs/Résumé.pdf", 300 << 10, 400 * 24 * time.Hour, false},
+	{"/home/me/my docs/test_42.txt", 10, 2 * time.Hour, false},
+	{"/home/me/my docs/100%_done.txt", 10, 2 * time.Hour, false},
+	{"/home/me/my docs/1000_done.txt", 10, 2 * time.Hour, false},
+}
+
+// newTestDb is files.db with the testFiles in it.
+func newTestDb(t *testing.T) *dbconnect.DbConnector {
+	t.Helper()
+	db := dbconnect.NewDbConnector(filepath.Join(t.TempDir(), "files.db"), 0, nil)
+	t.Cleanup(func() { db.DB.Close() })
+	if err := db.Migrate(dbconnect.FilesMigrations); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range testFiles {
+		dir, fname := filepath.Split(f.path)
+		err := db.Exec("INSERT INTO files (dir_id, path_to_file, fname, path_key, fname_key, size, mtime_ns, is_dir) VALUES (1,?,?,?,?,?,?,?)",
+			dir, fname, textfold.Key(dir), textfold.Key(fname), f.size, testNow.Add(-f.age).UnixNano(), f.isDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+// matching returns the sorted names of the files matching the query.
+func matching(t *testing.T, db *dbconnect.DbConnector, q string, caseSensitive bool) ([]string, error) {
+	t.Helper()
+	c, err := compileQuery(q, caseSensitive, Index{}, testNow)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT fname FROM files WHERE "+c.sql, c.args...)
+	if err != nil {
+		t.Fatalf("query %q: %v", q, err)
+	}
+	names := []string{}
+	for _, row := range rows {
+		names = append(names, row[0].(string))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func TestQuery(t *testing.T) {
+	db := newTestDb(t)
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"handler", []string{"handler.go", "handler_test.go"}},
+		{"HANDLER", []string{"handler.go", "handler_test.go"}},
+		{"resume", []string{"Résumé.pdf"}},
+		{"handler -test", []string{"handler.go"}},
+		{"handler NOT test", []string{"handler.go"}},
+		{"lib OR resume", []string{"Résumé.pdf", "lib.rs"}},
+		{"(lib OR resume) ext:pdf", []string{"Résumé.pdf"}},
+		{"*.go", []string{"handler.go", "handler_test.go"}},
+		{"ext:go,.rs", []string{"handler.go", "handler_test.go", "lib.rs"}},
+		{"size:>1M", []string{"lib.rs"}},
+		{"size:1K..4K", []string{"handler.go", "handler_test.go"}},
+		{"modified:<1d type:file", []string{"100%_done.txt", "1000_done.txt", "handler.go", "test_42.txt"}},
+		{"modified:<2023-06-01", []string{"Résumé.pdf"}},
+		{"type:dir", []string{"api"}},
+		{`path:"my docs" ext:pdf`, []string{"Résumé.pdf"}},
+		{`re:^test_\d+`, []string{"test_42.txt"}},
+	}
+	for _, test := range tests {
+		got, err := matching(t, db, test.query, false)
+		if err != nil {
+			t.Errorf("query %q: %v", test.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("query %q matched %v, want %v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestQueryCaseSensitive(t *testing.T) {
+	db := newTestDb(t)
+	got, err := matching(t, db, "Résumé", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Résumé.pdf"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("matched %v, want %v", got, want)
+	}
+	if got, _ := matching(t, db, "resume", true); len(got) != 0 {
+		t.Errorf("a case-sensitive search matched the folded name: %v", got)
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	for _, q := range []string{
+		"(handler",
+		"handler)",
+		`path:"my docs`,
+		"size:big",
+		"modified:yesterday",
+		"type:link",
+		"ext:",
+		"owner:me",
+		"re:(",
+	} {
+		if _, err := compileQuery(q, false, Index{}, testNow); err == nil {
+			t.Errorf("query %q compiled, want an error", q)
+		}
+	}
+}
+
+func TestLikeWildcardsAreLiteral(t *testing.T) {
+	db := newTestDb(t)
+	indexes := []Index{{}}
+	if db.EnableTrigram() {
+		indexes = append(indexes, Index{Trigram: true})
+	}
+	tests := []struct {
+		req  Request
+		want []string
+	}{
+		{Request{Pattern: "100%"}, []string{"100%_done.txt"}},
+		{Request{Pattern: "0_d"}, []string{"1000_done.txt"}},
+		{Request{Pattern: "%_done"}, []string{"100%_done.txt"}},
+		{Request{Pattern: "my_docs", Scope: FullPath}, []string{}},
+		{Request{Query: "path:0%_"}, []string{"100%_done.txt"}},
+	}
+	for _, idx := range indexes {
+		for _, test := range tests {
+			q, args, err := test.req.Select("fname", idx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows, err := db.Query(q, args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, row := range rows {
+				got = append(got, row[0].(string))
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%+v with %+v matched %v, want %v", test.req, idx, got, test.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package search
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/textfold"
+)
+
+// MaxCandidates is the most rows a ranked search scores. The rows are chosen by
+// the kind of their match and their path length, the rest are ignored.
+const MaxCandidates = 100000
+
+// The base scores of the kinds of matches. The path length and the age of
+// the file move the score by at most ±tierSpread, so the kinds never mix.
+const (
+	exactScore     = 1000
+	prefixScore    = 800
+	boundaryScore  = 600
+	substringScore = 400
+	fuzzyScore     = 100 // plus at most 100 for compactness
+
+	tierSpread  = 50
+	maxPathLen  = 256
+	recencyHalf = 30 * 24 * time.Hour
+)
+
+// Candidate is a row a ranked search has found.
+type Candidate struct {
+	Path    string
+	Fname   string
+	MtimeNs int64
+	Score   float64
+	Row     []interface{}
+}
+
+// subsequencePattern is the LIKE pattern matching every name that contains the
+// runes of pattern in order.
+func subsequencePattern(pattern string) string {
+	var b strings.Builder
+	b.WriteByte('%')
+	for _, r := range pattern {
+		if r == '%' || r == '_' || r == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+		b.WriteByte('%')
+	}
+	return b.String()
+}
+
+// Score tells how well the file matches pattern, the higher the better. It's 0
+// if the name doesn't contain the runes of pattern in order.
+func Score(pattern, path, fname string, mtimeNs int64, now time.Time) float64 {
+	name := textfold.Key(fname)
+	p := textfold.Key(pattern)
+
+	var score float64
+	switch {
+	case name == p:
+		score = exactScore
+	case strings.HasPrefix(name, p):
+		score = prefixScore
+	case atWordBoundary(fname, name, p):
+		score = boundaryScore
+	case strings.Contains(name, p):
+		score = substringScore
+	default:
+		compactness := subsequenceCompactness(name, p)
+		if compactness == 0 {
+			return 0
+		}
+		score = fuzzyScore + 100*compactness
+	}
+
+	pathLen := math.Min(float64(len(path)+len(fname)), maxPathLen)
+	score -= tierSpread * pathLen / maxPathLen
+
+	age := now.Sub(time.Unix(0, mtimeNs))
+	if age < 0 {
+		age = 0
+	}
+	score += tierSpread * math.Exp2(-float64(age)/float64(recencyHalf))
+
+	return score
+}
+
+// atWordBoundary reports whether p occurs in name right after a non-alphanumeric
+// rune or at a camelCase hump of the original fname.
+func atWordBoundary(fname, name, p string) bool {
+	if len(name) != len(fname) {
+		// folding changed the byte offsets, fall back to the folded name
+		fname = name
+	}
+	for i := strings.Index(name, p); i > 0; {
+		prev, _ := utf8.DecodeLastRuneInString(fname[:i])
+		cur, _ := utf8.DecodeRuneInString(fname[i:])
+		if !unicode.IsLetter(prev) && !unicode.IsDigit(prev) || unicode.IsLower(prev) && unicode.IsUpper(cur) {
+			return true
+		}
+		next := strings.Index(name[i+1:], p)
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return false
+}
+
+// subsequenceCompactness returns len(p) / the length of the shortest part of
+// name that contains the runes of p in order, or 0 if there's no such part.
+func subsequenceCompactness(name, p string) float64 {
+	needle := []rune(p)
+	hay := []rune(name)
+	if len(needle) == 0 {
+		return 0
+	}
+
+	best := 0
+	for start := range hay {
+		if hay[start] != needle[0] {
+			continue
+		}
+		j := 1
+		end := start
+		for i := start + 1; i < len(hay) && j < len(needle); i++ {
+			if hay[i] == needle[j] {
+				j++
+				end = i
+			}
+		}
+		if j < len(needle) {
+			break
+		}
+		if span := end - start + 1; best == 0 || span < best {
+			best = span
+		}
+	}
+	if best == 0 {
+		return 0
+	}
+	return float64(len(needle)) / float64(best)
+}
+
+// Rank scores the candidates, drops the ones not matching, and returns the best
+// limit of them in decreasing order of score, and the number of the matching ones.
+func Rank(pattern string, candidates []Candidate, limit int, now time.Time) ([]Candidate, int) {
+	ranked := candidates[:0]
+	for _, c := range candidates {
+		if c.Score = Score(pattern, c.Path, c.Fname, c.MtimeNs, now); c.Score > 0 {
+			ranked = append(ranked, c)
+		}
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].Score > ranked[j].Score
+	})
+	matches := len(ranked)
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+	return ranked, matches
+}
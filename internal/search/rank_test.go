@@ -0,0 +1,119 @@
+package search
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/dbconnect"
+	"github.com/ariadne-tools/ariadne-daemon/internal/textfold"
+)
+
+func TestScore(t *testing.T) {
+	score := func(path, fname string, age time.Duration) float64 {
+		return Score("handler", path, fname, testNow.Add(-age).UnixNano(), testNow)
+	}
+
+	// every kind of match beats the next one, however long its path and old its file
+	tiers := []struct {
+		kind   string
+		fnames []string
+	}{
+		{"exact", []string{"Handler"}},
+		{"prefix", []string{"handler.go"}},
+		{"boundary", []string{"api_handler.go", "apiHandler.go"}},
+		{"substring", []string{"apihandler.go"}},
+		{"fuzzy", []string{"h_a_n_d_l_e_r.go"}},
+	}
+	longPath := "/" + string(make([]byte, maxPathLen)) + "/"
+	for i := 1; i < len(tiers); i++ {
+		for _, better := range tiers[i-1].fnames {
+			for _, worse := range tiers[i].fnames {
+				if b, w := score(longPath, better, 10*365*24*time.Hour), score("/", worse, 0); b <= w {
+					t.Errorf("the %s match %q scored %v, the %s match %q %v", tiers[i-1].kind, better, b, tiers[i].kind, worse, w)
+				}
+			}
+		}
+	}
+
+	if s := score("/", "readme.md", 0); s != 0 {
+		t.Errorf("a name without the pattern scored %v", s)
+	}
+	if short, long := score("/src/", "handler.go", 0), score("/home/me/src/", "handler.go", 0); short <= long {
+		t.Errorf("the shorter path scored %v, the longer %v", short, long)
+	}
+	if recent, old := score("/src/", "handler.go", time.Hour), score("/src/", "handler.go", 365*24*time.Hour); recent <= old {
+		t.Errorf("the recent file scored %v, the old one %v", recent, old)
+	}
+	if compact, loose := score("/", "hand_ler.go", 0), score("/", "h_a_n_d_l_e_r.go", 0); compact <= loose {
+		t.Errorf("the compact fuzzy match scored %v, the loose one %v", compact, loose)
+	}
+}
+
+func TestRank(t *testing.T) {
+	var candidates []Candidate
+	for _, fname := range []string{"readme.md", "h_a_n_d_l_e_r.go", "handler.go", "apihandler.go", "Handler", "notes.txt"} {
+		candidates = append(candidates, Candidate{Path: "/src/", Fname: fname, MtimeNs: testNow.UnixNano()})
+	}
+
+	ranked, matches := Rank("handler", candidates, 3, testNow)
+	if matches != 4 {
+		t.Errorf("%d matches, want 4", matches)
+	}
+	var got []string
+	for _, c := range ranked {
+		got = append(got, c.Fname)
+	}
+	if want := []string{"Handler", "handler.go", "apihandler.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ranked %q, want %q", got, want)
+	}
+}
+
+func TestRankedCandidatesOrder(t *testing.T) {
+	db := dbconnect.NewDbConnector(filepath.Join(t.TempDir(), "files.db"), 0, nil)
+	t.Cleanup(func() { db.DB.Close() })
+	if err := db.Migrate(dbconnect.FilesMigrations); err != nil {
+		t.Fatal(err)
+	}
+	// the worst matches first, so the order of the rows doesn't help
+	for _, path := range []string{
+		"/h/a/n/d/l/e/r/h_a_n_d_l_e_r.go",
+		"/home/me/src/apihandler.go",
+		"/src/apihandler.go",
+		"/home/me/src/handler_test.go",
+		"/src/handler.go",
+		"/home/me/src/handler",
+	} {
+		dir, fname := filepath.Split(path)
+		err := db.Exec("INSERT INTO files (dir_id, path_to_file, fname, path_key, fname_key, size, mtime_ns, is_dir) VALUES (1,?,?,?,?,0,0,0)",
+			dir, fname, textfold.Key(dir), textfold.Key(fname))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q, args, err := Request{Pattern: "Handler", Mode: Ranked}.Select("path_to_file, fname", Index{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.Query(q, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, row := range rows {
+		got = append(got, row[0].(string)+row[1].(string))
+	}
+	want := []string{
+		"/home/me/src/handler",
+		"/src/handler.go",
+		"/home/me/src/handler_test.go",
+		"/src/apihandler.go",
+		"/home/me/src/apihandler.go",
+		"/h/a/n/d/l/e/r/h_a_n_d_l_e_r.go",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("the candidates came in the order\n%q\nwant\n%q", got, want)
+	}
+}
@@ -0,0 +1,356 @@
+package search
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/textfold"
+)
+
+const (
+	DefaultLimit = 1000
+	MaxLimit     = 10000
+)
+
+// Mode tells how the pattern of a Request is matched against the filenames.
+// Unless the search is case-sensitive, the search keys (see textfold.Key) of
+// the filenames and the pattern are matched, so case and diacritics don't count.
+type Mode string
+
+const (
+	Substring Mode = "substring" // the filename contains the pattern
+	Glob      Mode = "glob"      // the filename matches the pattern with *, ? and [...] wildcards
+	Regex     Mode = "regex"     // the filename matches the Go regular expression
+	Exact     Mode = "exact"     // the filename equals the pattern
+	Ranked    Mode = "ranked"    // the filename contains the runes of the pattern in order, best matches first
+)
+
+// Modes are all the modes of the searches.
+var Modes = []Mode{Substring, Glob, Regex, Exact, Ranked}
+
+// Scope tells what the pattern of a Request is matched against.
+type Scope string
+
+const (
+	Name     Scope = "name" // the filename
+	FullPath Scope = "path" // the full path of the file, e.g. "src/api" matches /home/me/src/api/handler.go
+)
+
+// Index tells which optional indexes of files.db the queries can use.
+type Index struct {
+	Trigram bool // files_fts, see dbconnect.EnableTrigram
+}
+
+// Request describes a search in the files table. The zero Mode means Substring,
+// and an empty Pattern matches everything in that mode. The zero Scope is Name.
+//
+// Results are ordered by path, and at most Limit of them are returned at once
+// (DefaultLimit if zero). The remaining ones can be fetched by passing the
+// cursor of the previous page in Cursor, until the daemon restarts. Ranked results are returned in
+// decreasing order of score instead, and only the first page is available.
+//
+// The other fields are optional filters on the attributes of the files; the
+// nil or empty ones are ignored. The bounds of the ranges are inclusive.
+type Request struct {
+	Pattern       string
+	Mode          Mode
+	Scope         Scope
+	AllTerms      bool   // only with FullPath and Substring: every whitespace separated term of Pattern has to be in the path
+	CaseSensitive bool   // match the filenames exactly as they are, ignored by Ranked
+	Query         string // in the query language, see query.go
+	Limit         int
+	Cursor        string
+	Id            string // chosen by the client to cancel the search while it runs, optional
+
+	MinSize    *int64
+	MaxSize    *int64
+	MinMtimeNs *int64
+	MaxMtimeNs *int64
+	IsDir      *bool
+	DirIds     []int  // the ids of the watched dirs to search in
+	PathPrefix string // only the entries below this directory are returned
+}
+
+// cursor is the position of the last row of a page: the primary key of the files table.
+type cursor struct {
+	Path  string
+	Fname string
+}
+
+// cursorAEAD seals the cursors with a key of this run of the daemon, so that
+// they don't tell the name of the last row to the callers it was filtered
+// out for. The cursors of the earlier runs are invalid.
+var cursorAEAD cipher.AEAD
+
+func init() {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	if cursorAEAD, err = cipher.NewGCM(block); err != nil {
+		panic(err)
+	}
+}
+
+// NextCursor returns the opaque cursor of the page ending with the given row.
+func NextCursor(path, fname string) string {
+	b, _ := json.Marshal(cursor{path, fname})
+	nonce := make([]byte, cursorAEAD.NonceSize())
+	rand.Read(nonce)
+	return base64.RawURLEncoding.EncodeToString(cursorAEAD.Seal(nonce, nonce, b, nil))
+}
+
+func parseCursor(s string) (cursor, error) {
+	var c cursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil && len(b) < cursorAEAD.NonceSize() {
+		err = fmt.Errorf("too short")
+	}
+	if err == nil {
+		n := cursorAEAD.NonceSize()
+		b, err = cursorAEAD.Open(nil, b[:n], b[n:], nil)
+	}
+	if err == nil {
+		err = json.Unmarshal(b, &c)
+	}
+	if err != nil {
+		return c, fmt.Errorf("search: invalid cursor %q, it may be of an earlier run of the daemon", s)
+	}
+	return c, nil
+}
+
+// Select compiles the request into a query returning the given columns of one
+// page. It asks for one row more than the page size, so the caller can tell if
+// there are more pages.
+func (req Request) Select(columns string, idx Index) (string, []interface{}, error) {
+	where, args, err := req.Where(idx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if req.Limit < 0 {
+		return "", nil, fmt.Errorf("search: negative limit %d", req.Limit)
+	}
+
+	if req.Mode == Ranked {
+		if req.Cursor != "" {
+			return "", nil, fmt.Errorf("search: ranked results can't be paged")
+		}
+		// the best MaxCandidates by the kind of the match and the path length,
+		// which are most of the score, so the best matches are among them
+		key := textfold.Key(req.Pattern)
+		order := "CASE WHEN fname_key = ? THEN 0 WHEN fname_key LIKE ? ESCAPE '\\' THEN 1 WHEN instr(fname_key, ?) > 0 THEN 2 ELSE 3 END, " +
+			"length(path_to_file) + length(fname)"
+		args = append(args, key, escapeLike(key)+"%", key, MaxCandidates)
+		return "SELECT " + columns + " FROM files WHERE " + where + " ORDER BY " + order + " LIMIT ?", args, nil
+	}
+
+	if req.Cursor != "" {
+		c, err := parseCursor(req.Cursor)
+		if err != nil {
+			return "", nil, err
+		}
+		where = "(" + where + ") AND (path_to_file, fname) > (?, ?)"
+		args = append(args, c.Path, c.Fname)
+	}
+
+	q := "SELECT " + columns + " FROM files WHERE " + where + " ORDER BY path_to_file, fname LIMIT ?"
+	return q, append(args, req.PageSize()+1), nil
+}
+
+// PageSize returns the number of rows a page of the request holds.
+func (req Request) PageSize() int {
+	switch {
+	case req.Limit <= 0:
+		return DefaultLimit
+	case req.Limit > MaxLimit:
+		return MaxLimit
+	default:
+		return req.Limit
+	}
+}
+
+// Where compiles the request into an SQL condition over the files table and its arguments.
+func (req Request) Where(idx Index) (string, []interface{}, error) {
+	var conds []string
+	var args []interface{}
+
+	if req.Pattern != "" || req.Mode != "" && req.Mode != Substring {
+		cond, condArgs, err := req.nameCondition(idx)
+		if err != nil {
+			return "", nil, err
+		}
+		conds = append(conds, cond)
+		args = append(args, condArgs...)
+	}
+
+	if req.Query != "" {
+		c, err := compileQuery(req.Query, req.CaseSensitive, idx, time.Now())
+		if err != nil {
+			return "", nil, err
+		}
+		conds = append(conds, c.sql)
+		args = append(args, c.args...)
+	}
+
+	bounds := []struct {
+		cond  string
+		value *int64
+	}{
+		{"size >= ?", req.MinSize},
+		{"size <= ?", req.MaxSize},
+		{"mtime_ns >= ?", req.MinMtimeNs},
+		{"mtime_ns <= ?", req.MaxMtimeNs},
+	}
+	for _, b := range bounds {
+		if b.value != nil {
+			conds = append(conds, b.cond)
+			args = append(args, *b.value)
+		}
+	}
+
+	if req.IsDir != nil {
+		conds = append(conds, "is_dir = ?")
+		args = append(args, *req.IsDir)
+	}
+
+	if len(req.DirIds) > 0 {
+		conds = append(conds, "dir_id IN (?"+strings.Repeat(",?", len(req.DirIds)-1)+")")
+		for _, id := range req.DirIds {
+			args = append(args, id)
+		}
+	}
+
+	if req.PathPrefix != "" {
+		if !path.IsAbs(req.PathPrefix) {
+			return "", nil, fmt.Errorf("search: path prefix %q is not absolute", req.PathPrefix)
+		}
+		// path_to_file always ends with a slash, and '0' follows '/', so this range
+		// covers every path below the prefix, and it can be looked up in the index.
+		prefix := strings.TrimSuffix(path.Clean(req.PathPrefix), "/") + "/"
+		conds = append(conds, "path_to_file >= ? AND path_to_file < ?")
+		args = append(args, prefix, strings.TrimSuffix(prefix, "/")+"0")
+	}
+
+	if len(conds) == 0 {
+		return "1", nil, nil
+	}
+	return strings.Join(conds, " AND "), args, nil
+}
+
+func (req Request) nameCondition(idx Index) (string, []interface{}, error) {
+	switch req.Scope {
+	case "", Name:
+		return matchName(nameTarget, req.Mode, req.Pattern, req.CaseSensitive, idx)
+	case FullPath:
+		if req.Mode == Ranked {
+			return "", nil, fmt.Errorf("search: ranked search is available only by name")
+		}
+		if !req.AllTerms {
+			return matchName(pathTarget, req.Mode, req.Pattern, req.CaseSensitive, idx)
+		}
+
+		if req.Mode != "" && req.Mode != Substring {
+			return "", nil, fmt.Errorf("search: all terms are matched only as substrings, not in %s mode", req.Mode)
+		}
+		terms := strings.Fields(req.Pattern)
+		if len(terms) == 0 {
+			return "", nil, fmt.Errorf("search: no terms to search for")
+		}
+		// Every term is matched whole, so a term without a slash is in a single
+		// component of the path, and the components of one with slashes are
+		// consecutive: src/api is in /home/src/api/, but not in /srcapi/.
+		var conds []string
+		var args []interface{}
+		for _, term := range terms {
+			cond, termArgs, _ := matchName(pathTarget, Substring, term, req.CaseSensitive, idx)
+			conds = append(conds, cond)
+			args = append(args, termArgs...)
+		}
+		return strings.Join(conds, " AND "), args, nil
+	default:
+		return "", nil, fmt.Errorf("search: unknown scope %q", req.Scope)
+	}
+}
+
+// target is what the pattern of a search is matched against: an exact
+// expression, and the one of its search key.
+type target struct {
+	exact   string
+	key     string
+	trigram bool // files_fts indexes the key
+}
+
+var (
+	nameTarget = target{"fname", "fname_key", true}
+	pathTarget = target{"path_to_file || fname", "path_key || fname_key", false}
+)
+
+func matchName(t target, mode Mode, pattern string, caseSensitive bool, idx Index) (string, []interface{}, error) {
+	key := textfold.Key(pattern)
+	// the trigram index is useless for patterns shorter than a trigram
+	trigram := t.trigram && idx.Trigram && utf8.RuneCountInString(key) >= 3
+
+	switch mode {
+	case "", Substring:
+		if caseSensitive {
+			if trigram {
+				return trigramCondition + " AND instr(" + t.exact + ", ?) > 0", []interface{}{key, pattern}, nil
+			}
+			return "instr(" + t.exact + ", ?) > 0", []interface{}{pattern}, nil
+		}
+		like := "%" + escapeLike(key) + "%"
+		if trigram && strings.ContainsAny(key, `%_`) {
+			// the trigram index takes them for wildcards, so it only narrows down the rows
+			return trigramCondition + " AND " + t.key + " LIKE ? ESCAPE '\\'", []interface{}{key, like}, nil
+		}
+		if trigram {
+			return trigramCondition, []interface{}{key}, nil
+		}
+		return t.key + " LIKE ? ESCAPE '\\'", []interface{}{like}, nil
+	case Glob:
+		if caseSensitive {
+			return t.exact + " GLOB ?", []interface{}{pattern}, nil
+		}
+		return t.key + " GLOB ?", []interface{}{key}, nil
+	case Regex:
+		if _, err := regexp.Compile(pattern); err != nil {
+			return "", nil, fmt.Errorf("search: invalid regular expression: %v", err)
+		}
+		if caseSensitive {
+			return t.exact + " REGEXP ?", []interface{}{pattern}, nil
+		}
+		// the pattern can't be folded, so it may match either the name or the key
+		pattern = "(?i)" + pattern
+		return "(" + t.exact + " REGEXP ? OR " + t.key + " REGEXP ?)", []interface{}{pattern, pattern}, nil
+	case Exact:
+		if caseSensitive {
+			return t.exact + " = ?", []interface{}{pattern}, nil
+		}
+		return t.key + " = ?", []interface{}{key}, nil
+	case Ranked:
+		return t.key + " LIKE ? ESCAPE '\\'", []interface{}{subsequencePattern(key)}, nil
+	default:
+		return "", nil, fmt.Errorf("search: unknown match mode %q", mode)
+	}
+}
+
+// escapeLike escapes the wildcards of LIKE, for ESCAPE '\'.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+const trigramCondition = "rowid IN (SELECT rowid FROM files_fts WHERE fname_key LIKE '%'||?||'%')"
@@ -0,0 +1,217 @@
+package search
+
+import (
+	"encoding/base64"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/ariadne-tools/ariadne-daemon/internal/textfold"
+)
+
+func TestCursor(t *testing.T) {
+	next := NextCursor("/home/me/secret/", "plans.txt")
+	if next == NextCursor("/home/me/secret/", "plans.txt") {
+		t.Errorf("the cursors of the same row are the same")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), "secret") || strings.Contains(string(raw), "plans") {
+		t.Errorf("the cursor tells the row it ends with: %q", raw)
+	}
+
+	c, err := parseCursor(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (cursor{"/home/me/secret/", "plans.txt"}); c != want {
+		t.Errorf("parsed %+v, want %+v", c, want)
+	}
+
+	raw[len(raw)-1] ^= 1
+	for _, s := range []string{"", "x", "!!", base64.RawURLEncoding.EncodeToString(raw),
+		base64.RawURLEncoding.EncodeToString([]byte(`{"Path":"/","Fname":"a"}`))} {
+		if _, err := parseCursor(s); err == nil {
+			t.Errorf("parsed the invalid cursor %q", s)
+		}
+	}
+}
+
+func TestPages(t *testing.T) {
+	db := newTestDb(t)
+	var got []string
+	req := Request{Query: "type:file", Limit: 3}
+	for pages := 0; ; pages++ {
+		if pages == len(testFiles) {
+			t.Fatal("the paging doesn't end")
+		}
+		q, args, err := req.Select("path_to_file, fname", Index{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := db.Query(q, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) <= req.PageSize() {
+			for _, row := range rows {
+				got = append(got, row[0].(string)+row[1].(string))
+			}
+			break
+		}
+		rows = rows[:req.PageSize()]
+		for _, row := range rows {
+			got = append(got, row[0].(string)+row[1].(string))
+		}
+		last := rows[len(rows)-1]
+		req.Cursor = NextCursor(last[0].(string), last[1].(string))
+	}
+
+	// by path_to_file first, so "/home/me/src/" comes before "/home/me/src/api/"
+	want := []string{
+		"/home/me/my docs/100%_done.txt",
+		"/home/me/my docs/1000_done.txt",
+		"/home/me/my docs/Résumé.pdf",
+		"/home/me/my docs/test_42.txt",
+		"/home/me/src/lib.rs",
+		"/home/me/src/api/handler.go",
+		"/home/me/src/api/handler_test.go",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("the pages have %v, want %v", got, want)
+	}
+}
+
+func TestAllTerms(t *testing.T) {
+	db := newTestDb(t)
+	for _, path := range []string{"/home/me/srcapi/handler.go", "/home/me/src/lib/api/handler.go"} {
+		dir, fname := filepath.Split(path)
+		err := db.Exec("INSERT INTO files (dir_id, path_to_file, fname, path_key, fname_key, size, mtime_ns, is_dir) VALUES (1,?,?,?,?,0,0,0)",
+			dir, fname, textfold.Key(dir), textfold.Key(fname))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"src/api handler", []string{"/home/me/src/api/handler.go", "/home/me/src/api/handler_test.go"}},
+		{"handler src api", []string{
+			"/home/me/src/api/handler.go", "/home/me/src/api/handler_test.go",
+			"/home/me/src/lib/api/handler.go", "/home/me/srcapi/handler.go",
+		}},
+		{"srcapi", []string{"/home/me/srcapi/handler.go"}},
+		{"c/a", []string{"/home/me/src/api", "/home/me/src/api/handler.go", "/home/me/src/api/handler_test.go"}},
+		{"SRC/API/handler.go", []string{"/home/me/src/api/handler.go"}},
+		{"docs/résumé me", []string{"/home/me/my docs/Résumé.pdf"}},
+		{"src/api/ lib", []string{}},
+	}
+	for _, test := range tests {
+		q, args, err := Request{Pattern: test.pattern, Scope: FullPath, AllTerms: true}.Select("path_to_file, fname", Index{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := db.Query(q, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, row := range rows {
+			got = append(got, row[0].(string)+row[1].(string))
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("the terms %q matched %q, want %q", test.pattern, got, test.want)
+		}
+	}
+
+	for _, mode := range []Mode{Glob, Regex, Exact, Ranked} {
+		if _, _, err := (Request{Pattern: "src", Scope: FullPath, AllTerms: true, Mode: mode}).Where(Index{}); err == nil {
+			t.Errorf("all terms were matched in %s mode", mode)
+		}
+	}
+	if _, _, err := (Request{Pattern: "src", Scope: FullPath, AllTerms: true, Mode: Substring}).Where(Index{}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestModes(t *testing.T) {
+	db := newTestDb(t)
+	for _, path := range []string{
+		"/home/me/proj/main.go",
+		"/home/me/proj/README.md",
+		"/home/me/proj/docs/README",
+		"/home/me/proj/docs/readme.txt",
+		"/home/me/proj/test_42.py",
+		"/home/me/proj/test_x.py",
+		"/home/me/proj/test_7.pyc",
+		"/home/me/proj/Ärger.txt",
+	} {
+		dir, fname := filepath.Split(path)
+		err := db.Exec("INSERT INTO files (dir_id, path_to_file, fname, path_key, fname_key, size, mtime_ns, is_dir) VALUES (1,?,?,?,?,0,0,0)",
+			dir, fname, textfold.Key(dir), textfold.Key(fname))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		req  Request
+		want []string
+	}{
+		{Request{Mode: Glob, Pattern: "*.go"}, []string{"handler.go", "handler_test.go", "main.go"}},
+		{Request{Mode: Glob, Pattern: "*.GO"}, []string{"handler.go", "handler_test.go", "main.go"}},
+		{Request{Mode: Glob, Pattern: "*.GO", CaseSensitive: true}, []string{}},
+		{Request{Mode: Glob, Pattern: "test_?.py*"}, []string{"test_7.pyc", "test_x.py"}},
+		{Request{Mode: Glob, Pattern: "résumé.*"}, []string{"Résumé.pdf"}},
+		{Request{Mode: Glob, Pattern: "*/docs/*", Scope: FullPath}, []string{"README", "readme.txt"}},
+
+		{Request{Mode: Regex, Pattern: "^README"}, []string{"README", "README.md", "readme.txt"}},
+		{Request{Mode: Regex, Pattern: "^README", CaseSensitive: true}, []string{"README", "README.md"}},
+		{Request{Mode: Regex, Pattern: `test_[0-9]+\.py$`}, []string{"test_42.py"}},
+		// the names and their folded keys
+		{Request{Mode: Regex, Pattern: "^är"}, []string{"Ärger.txt"}},
+		{Request{Mode: Regex, Pattern: "^ar"}, []string{"Ärger.txt"}},
+		{Request{Mode: Regex, Pattern: "^ar", CaseSensitive: true}, []string{}},
+		{Request{Mode: Regex, Pattern: "^RÉSUMÉ"}, []string{"Résumé.pdf"}},
+		{Request{Mode: Regex, Pattern: `^resume\.pdf$`}, []string{"Résumé.pdf"}},
+		{Request{Mode: Regex, Pattern: `/proj/test_\d+`, Scope: FullPath}, []string{"test_42.py", "test_7.pyc"}},
+
+		{Request{Mode: Exact, Pattern: "readme.md"}, []string{"README.md"}},
+		{Request{Mode: Exact, Pattern: "readme.md", CaseSensitive: true}, []string{}},
+		{Request{Mode: Exact, Pattern: "README.md", CaseSensitive: true}, []string{"README.md"}},
+		{Request{Mode: Exact, Pattern: "resume.pdf"}, []string{"Résumé.pdf"}},
+		{Request{Mode: Exact, Pattern: "Résumé.pdf", CaseSensitive: true}, []string{"Résumé.pdf"}},
+		{Request{Mode: Exact, Pattern: "main"}, []string{}},
+		{Request{Mode: Exact, Pattern: "/home/me/proj/main.go", Scope: FullPath}, []string{"main.go"}},
+	}
+	for _, test := range tests {
+		q, args, err := test.req.Select("fname", Index{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := db.Query(q, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, row := range rows {
+			got = append(got, row[0].(string))
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s %q (case-sensitive %v, scope %q) matched %q, want %q",
+				test.req.Mode, test.req.Pattern, test.req.CaseSensitive, test.req.Scope, got, test.want)
+		}
+	}
+
+	if _, _, err := (Request{Mode: Regex, Pattern: "test_[0-9"}).Where(Index{}); err == nil {
+		t.Error("an invalid regular expression was accepted")
+	}
+}
@@ -0,0 +1,33 @@
+package textfold
+
+import (
+	"sync"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// the transformers are stateful, so each goroutine needs its own
+var folders = sync.Pool{
+	New: func() interface{} {
+		return transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), cases.Fold(), norm.NFC)
+	},
+}
+
+// Key returns the search key of s: it's case folded, stripped of diacritics and
+// NFC normalized, so "Árvíztűrő" and "arvizturo" have the same key, no matter
+// if they were written in NFC or NFD.
+func Key(s string) string {
+	t := folders.Get().(transform.Transformer)
+	defer folders.Put(t)
+
+	key, _, err := transform.String(t, s)
+	if err != nil {
+		// invalid UTF-8, which can't be folded
+		return s
+	}
+	return key
+}
@@ -0,0 +1,56 @@
+package textfold
+
+import (
+	"sync"
+	"testing"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+func TestKey(t *testing.T) {
+	tests := []struct {
+		s, key string
+	}{
+		{"arvizturo", "arvizturo"},
+		{"Árvíztűrő.txt", "arvizturo.txt"},
+		{norm.NFD.String("Árvíztűrő.txt"), "arvizturo.txt"},
+		{"ÁRVÍZTŰRŐ TÜKÖRFÚRÓGÉP", "arvizturo tukorfurogep"},
+		{"Résumé.PDF", "resume.pdf"},
+		{"Straße", "strasse"},
+		{"ΣΊΣΥΦΟΣ", "σισυφοσ"},
+		// the Hangul syllables are decomposed into jamo, which aren't marks, and composed again
+		{"한글.txt", "한글.txt"},
+		{norm.NFD.String("한글.txt"), "한글.txt"},
+		{"/home/me/src/", "/home/me/src/"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if key := Key(test.s); key != test.key {
+			t.Errorf("the key of %q is %q, want %q", test.s, key, test.key)
+		}
+	}
+
+	if Key("arvizturo") != Key(norm.NFD.String("Árvíztűrő")) || Key("Árvíztűrő") != Key(norm.NFD.String("Árvíztűrő")) {
+		t.Error("the NFC and NFD forms have different keys")
+	}
+	if key := Key(norm.NFD.String("Árvíztűrő")); !norm.NFC.IsNormalString(key) {
+		t.Errorf("the key %q is not NFC", key)
+	}
+}
+
+func TestKeyConcurrently(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if key := Key("Árvíztűrő.txt"); key != "arvizturo.txt" {
+					t.Errorf("the key is %q", key)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}